@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	gentlemancontext "gopkg.in/h2non/gentleman.v2/context"
+	"gopkg.in/h2non/gentleman.v2/plugin"
+)
+
+const (
+	// Default time to wait for the response to an API request.
+	clientDefaultTimeout = 60 * time.Second
+
+	// Default number of times a failed API request is retried.
+	clientDefaultRetries = 3
+
+	// Delay before the first retry of a request, doubled after each retry
+	// up to clientMaxRetryDelay.
+	clientRetryDelay    = 500 * time.Millisecond
+	clientMaxRetryDelay = 30 * time.Second
+)
+
+// clientSettings configures the requests to the API of a context. They are
+// read from the timeout, retries and rate_limit keys of the context in
+// credentials.json.
+type clientSettings struct {
+	timeout   time.Duration
+	retries   int
+	rateLimit float64
+}
+
+// getClientSettings returns the client settings of the current context.
+func getClientSettings() clientSettings {
+	settings := clientSettings{
+		timeout: clientDefaultTimeout,
+		retries: clientDefaultRetries,
+	}
+	context := viper.GetString("context")
+	if context == "" {
+		context = cli.Creds.GetString("default.context")
+	}
+	key := "contexts." + context + "."
+	if cli.Creds.IsSet(key + "timeout") {
+		if timeout, err := time.ParseDuration(cli.Creds.GetString(key + "timeout")); err == nil {
+			settings.timeout = timeout
+		} else {
+			logger.Printf("Invalid timeout %q in context %s, using %s", cli.Creds.GetString(key+"timeout"), context, settings.timeout)
+		}
+	}
+	if cli.Creds.IsSet(key + "retries") {
+		settings.retries = cli.Creds.GetInt(key + "retries")
+	}
+	if cli.Creds.IsSet(key + "rate_limit") {
+		settings.rateLimit = cli.Creds.GetFloat64(key + "rate_limit")
+	}
+	return settings
+}
+
+// rateLimiter spaces out requests so that no more than a given number of
+// requests per second are sent.
+type rateLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks until the next request may be sent at rate requests per
+// second, or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, rate float64) error {
+	if rate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(time.Duration(float64(time.Second) / rate))
+	l.mu.Unlock()
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var apiRateLimiter = &rateLimiter{}
+
+// apiTransport sends the requests to the API with a timeout, retrying
+// requests that failed with a transient error and rate limiting them as
+// configured in the current context. Each attempt is logged as set by
+// --verbose.
+type apiTransport struct {
+	base http.RoundTripper
+}
+
+func newAPITransport(base http.RoundTripper) *apiTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &apiTransport{base: &tracingTransport{base: base}}
+}
+
+// isIdempotent returns whether a request can be sent again after it may
+// have reached the API.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
+
+// shouldRetry returns whether a request that returned resp or err should be
+// retried. Requests that are not idempotent are only retried when the API
+// rejected them with 429 Too Many Requests.
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return isIdempotent(req) && req.Context().Err() == nil
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return resp.StatusCode >= 500 && isIdempotent(req)
+}
+
+// retryAfter returns the delay requested by the Retry-After header of resp,
+// either in seconds or as an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		delay := time.Until(at)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+func (t *apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	settings := getClientSettings()
+	delay := clientRetryDelay
+	for attempt := 0; ; attempt++ {
+		if err := apiRateLimiter.wait(req.Context(), settings.rateLimit); err != nil {
+			return nil, err
+		}
+		resp, err := t.roundTrip(req, settings.timeout)
+		if attempt >= settings.retries || !shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		// Jitter keeps clients that failed together from retrying in
+		// lockstep.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if after, ok := retryAfter(resp); ok {
+			wait = after
+			if wait > clientMaxRetryDelay {
+				wait = clientMaxRetryDelay
+			}
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		delay *= 2
+		if delay > clientMaxRetryDelay {
+			delay = clientMaxRetryDelay
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// roundTrip sends a single attempt of req, which fails if the response
+// has not been read within timeout.
+func (t *apiTransport) roundTrip(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return t.base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels the context of a request when its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// apiClientPlugin sends the requests of cli.Client through apiTransport,
+// wrapping the transport it would have used otherwise.
+func apiClientPlugin() plugin.Plugin {
+	return plugin.NewRequestPlugin(func(ctx *gentlemancontext.Context, h gentlemancontext.Handler) {
+		if _, ok := ctx.Client.Transport.(*apiTransport); !ok {
+			ctx.Client.Transport = newAPITransport(ctx.Client.Transport)
+		}
+		h.Next(ctx)
+	})
+}
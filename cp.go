@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	terminal "golang.org/x/term"
+)
+
+// base64LineLength is the number of bytes encoded on each line of input
+// sent to the remote terminal, matching the output of base64(1).
+const base64LineLength = 57
+
+type remoteFile struct {
+	machine string
+	path    string
+}
+
+// parseCopyArg returns the machine and path of a MACHINE:PATH argument. A
+// single letter before the colon is treated as a Windows drive letter.
+func parseCopyArg(arg string) (remoteFile, bool) {
+	i := strings.Index(arg, ":")
+	if i <= 1 || strings.ContainsAny(arg[:i], `/\`) {
+		return remoteFile{}, false
+	}
+	p := arg[i+1:]
+	if p == "" {
+		p = "."
+	}
+	return remoteFile{machine: arg[:i], path: p}, true
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remoteShellPath quotes a remote path, keeping a leading ~ expandable.
+func remoteShellPath(p string) string {
+	if p == "~" {
+		return `"$HOME"`
+	}
+	if strings.HasPrefix(p, "~/") {
+		return `"$HOME"/` + shellQuote(p[2:])
+	}
+	return shellQuote(p)
+}
+
+// copyProgress reports the progress of a transfer on stderr, if stderr is
+// a terminal.
+type copyProgress struct {
+	name    string
+	total   int64
+	current int64
+	enabled bool
+}
+
+func newCopyProgress(name string, total int64) *copyProgress {
+	p := &copyProgress{name: name, total: total, enabled: terminal.IsTerminal(int(os.Stderr.Fd()))}
+	p.print()
+	return p
+}
+
+func (p *copyProgress) Write(b []byte) (int, error) {
+	p.current += int64(len(b))
+	p.print()
+	return len(b), nil
+}
+
+func (p *copyProgress) print() {
+	if !p.enabled {
+		return
+	}
+	percent := int64(100)
+	if p.total > 0 {
+		percent = p.current * 100 / p.total
+	}
+	fmt.Fprintf(os.Stderr, "\r%s  %s / %s  %3d%%", p.name, formatBytes(p.current), formatBytes(p.total), percent)
+}
+
+func (p *copyProgress) Done() {
+	if p.enabled {
+		fmt.Fprintln(os.Stderr, "")
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for i := n / unit; i >= unit; i /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// encodeLines writes r to w as base64, one line per base64LineLength bytes.
+func encodeLines(w io.Writer, r io.Reader) error {
+	line := make([]byte, base64LineLength)
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(base64LineLength)+1)
+	for {
+		n, err := io.ReadFull(r, line)
+		if n > 0 {
+			base64.StdEncoding.Encode(encoded, line[:n])
+			size := base64.StdEncoding.EncodedLen(n)
+			encoded[size] = '\n'
+			if _, err := w.Write(encoded[:size+1]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func remoteChecksum(s *remoteShell, remotePath string) (string, error) {
+	out, err := s.output("sha256sum < " + remoteShellPath(remotePath))
+	if err != nil {
+		return "", fmt.Errorf("Could not calculate checksum of %s: %s", remotePath, err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("Could not calculate checksum of %s", remotePath)
+	}
+	return fields[0], nil
+}
+
+func verifyChecksum(s *remoteShell, remotePath string, h hash.Hash) error {
+	remoteSum, err := remoteChecksum(s, remotePath)
+	if err != nil {
+		return err
+	}
+	if localSum := hex.EncodeToString(h.Sum(nil)); localSum != remoteSum {
+		return fmt.Errorf("Checksum mismatch for %s: local %s, remote %s", remotePath, localSum, remoteSum)
+	}
+	return nil
+}
+
+func isRemoteDir(s *remoteShell, remotePath string) (bool, error) {
+	exitCode, err := s.run("test -d "+remoteShellPath(remotePath), nil, io.Discard)
+	if err != nil {
+		return false, err
+	}
+	return exitCode == 0, nil
+}
+
+func uploadFile(s *remoteShell, localPath, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	progress := newCopyProgress(remotePath, info.Size())
+	defer progress.Done()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encodeLines(pw, io.TeeReader(f, io.MultiWriter(h, progress))))
+	}()
+	var out strings.Builder
+	exitCode, err := s.run("base64 -d > "+remoteShellPath(remotePath), pr, &out)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("Could not write %s: %s", remotePath, strings.TrimSpace(out.String()))
+	}
+	return verifyChecksum(s, remotePath, h)
+}
+
+func downloadFile(s *remoteShell, remotePath, localPath string) error {
+	out, err := s.output("wc -c < " + remoteShellPath(remotePath))
+	if err != nil {
+		return fmt.Errorf("Could not read %s: %s", remotePath, err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Could not read size of %s: %s", remotePath, err)
+	}
+	f, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	progress := newCopyProgress(localPath, size)
+	defer progress.Done()
+	pr, pw := io.Pipe()
+	decoded := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.MultiWriter(f, h, progress), base64.NewDecoder(base64.StdEncoding, pr))
+		pr.CloseWithError(err)
+		decoded <- err
+	}()
+	exitCode, err := s.run("base64 < "+remoteShellPath(remotePath), nil, pw)
+	pw.Close()
+	if decodeErr := <-decoded; err == nil && decodeErr != nil {
+		err = fmt.Errorf("Could not decode %s: %s", remotePath, decodeErr)
+	}
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("Could not read %s", remotePath)
+	}
+	return verifyChecksum(s, remotePath, h)
+}
+
+func upload(s *remoteShell, localPath, remotePath string, recursive bool) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && !recursive {
+		return fmt.Errorf("%s is a directory (use --recursive to copy directories)", localPath)
+	}
+	isDir, err := isRemoteDir(s, remotePath)
+	if err != nil {
+		return err
+	}
+	if isDir {
+		remotePath = path.Join(remotePath, filepath.Base(localPath))
+	}
+	if !info.IsDir() {
+		return uploadFile(s, localPath, remotePath)
+	}
+	return filepath.Walk(localPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(remotePath, filepath.ToSlash(rel))
+		if info.IsDir() {
+			_, err := s.output("mkdir -p " + remoteShellPath(target))
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return uploadFile(s, p, target)
+	})
+}
+
+// listRemoteFiles returns the paths of all entries of the given type below
+// a remote directory, relative to it.
+func listRemoteFiles(s *remoteShell, remotePath, fileType string) ([]string, error) {
+	out, err := s.output("cd " + remoteShellPath(remotePath) + " && find . -type " + fileType)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list %s: %s", remotePath, err)
+	}
+	files := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		if line := strings.TrimPrefix(scanner.Text(), "./"); line != "" && line != "." {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+func download(s *remoteShell, remotePath, localPath string, recursive bool) error {
+	isDir, err := isRemoteDir(s, remotePath)
+	if err != nil {
+		return err
+	}
+	if isDir && !recursive {
+		return fmt.Errorf("%s is a directory (use --recursive to copy directories)", remotePath)
+	}
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		localPath = filepath.Join(localPath, path.Base(remotePath))
+	}
+	if !isDir {
+		return downloadFile(s, remotePath, localPath)
+	}
+	dirs, err := listRemoteFiles(s, remotePath, "d")
+	if err != nil {
+		return err
+	}
+	for _, dir := range append([]string{"."}, dirs...) {
+		if err := os.MkdirAll(filepath.Join(localPath, filepath.FromSlash(dir)), 0755); err != nil {
+			return err
+		}
+	}
+	files, err := listRemoteFiles(s, remotePath, "f")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := downloadFile(s, path.Join(remotePath, file), filepath.Join(localPath, filepath.FromSlash(file))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cpCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "cp SOURCE DESTINATION",
+		Short: "Copy files to and from a machine",
+		Long: `Copy files to and from a machine over its ssh connection.
+
+  Exactly one of SOURCE and DESTINATION must be a remote path in the form
+  MACHINE:PATH. Checksums of the copied files are verified at the end.`,
+		Example: `  mist cp ./app.conf machine-name:/etc/app/app.conf
+  mist cp machine-name:/var/log/syslog .
+  mist cp --recursive ./site machine-name:/var/www`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			src, srcRemote := parseCopyArg(args[0])
+			dst, dstRemote := parseCopyArg(args[1])
+			if srcRemote == dstRemote {
+				logger.Fatal("Exactly one of SOURCE and DESTINATION must be in the form MACHINE:PATH")
+			}
+			machine := src.machine
+			if dstRemote {
+				machine = dst.machine
+			}
+			s, err := openRemoteShell(machine)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			defer s.Close()
+			if dstRemote {
+				err = upload(s, args[0], dst.path, params.GetBool("recursive"))
+			} else {
+				err = download(s, src.path, args[1], params.GetBool("recursive"))
+			}
+			if err != nil {
+				s.Close()
+				logger.Fatal(err)
+			}
+		},
+	}
+	cmd.Flags().BoolP("recursive", "r", false, "Copy directories recursively")
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// connectionInfo describes the connection of the ssh session, for the ~#
+// escape sequence.
+type connectionInfo struct {
+	mu          sync.Mutex
+	machine     string
+	remoteAddr  string
+	connectedAt time.Time
+	latency     time.Duration
+}
+
+var sessionConnection = &connectionInfo{}
+
+func (i *connectionInfo) connected(c *websocket.Conn) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.remoteAddr = c.RemoteAddr().String()
+	i.connectedAt = time.Now()
+	i.latency = 0
+}
+
+// pong records the round trip time of a ping sent by sendPingMessages,
+// which carries the time it was sent.
+func (i *connectionInfo) pong(appData string) {
+	sent, err := strconv.ParseInt(appData, 10, 64)
+	if err != nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.latency = time.Since(time.Unix(0, sent))
+}
+
+func (i *connectionInfo) String() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	latency := "unknown"
+	if i.latency > 0 {
+		latency = i.latency.Round(time.Millisecond).String()
+	}
+	return fmt.Sprintf("Connected to %s via %s for %s, latency %s",
+		i.machine, i.remoteAddr, time.Since(i.connectedAt).Round(time.Second), latency)
+}
+
+func printEscapeHelp(escapeChar byte) {
+	help := []string{
+		"Supported escape sequences:",
+		" %[1]c.   - terminate connection",
+		" %[1]c#   - show connection info and latency",
+		" %[1]c?   - this message",
+		" %[1]c%[1]c   - send the escape character by typing it twice",
+		"(Note that escapes are only recognized immediately after newline.)",
+	}
+	fmt.Fprintf(os.Stderr, "\r\n"+strings.Join(help, "\r\n")+"\r\n", escapeChar)
+}
+
+// filterEscapes handles OpenSSH-style escape sequences typed at the start
+// of a line and forwards the rest of input. The returned channel is closed
+// when input is closed or the ~. escape sequence is typed.
+func filterEscapes(input <-chan []byte, escapeChar byte) <-chan []byte {
+	output := make(chan []byte, cap(input))
+	go func() {
+		defer close(output)
+		lineStart := true
+		escaped := false
+		for data := range input {
+			forward := make([]byte, 0, len(data)+1)
+			for _, b := range data {
+				if escaped {
+					escaped = false
+					switch b {
+					case '.':
+						if len(forward) > 0 {
+							output <- forward
+						}
+						printSessionStatus("Connection to %s closed", sessionConnection.machine)
+						return
+					case '?':
+						printEscapeHelp(escapeChar)
+						continue
+					case '#':
+						printSessionStatus("%s", sessionConnection)
+						continue
+					case escapeChar:
+						forward = append(forward, b)
+						lineStart = false
+						continue
+					default:
+						forward = append(forward, escapeChar)
+					}
+				} else if lineStart && b == escapeChar {
+					escaped = true
+					continue
+				}
+				forward = append(forward, b)
+				lineStart = b == '\r' || b == '\n'
+			}
+			if len(forward) > 0 {
+				output <- forward
+			}
+		}
+	}()
+	return output
+}
+
+// parseEscapeChar parses the value of --escape-char. It returns false if
+// escape sequences are disabled.
+func parseEscapeChar(value string) (byte, bool, error) {
+	if value == "none" {
+		return 0, false, nil
+	}
+	if len(value) != 1 {
+		return 0, false, fmt.Errorf("Invalid escape character %q, expected a single character or none", value)
+	}
+	return value[0], true, nil
+}
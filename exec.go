@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// remoteCommandExitCode is returned when the exit status of a remote
+// command could not be determined, matching the convention of ssh(1).
+const remoteCommandExitCode = 255
+
+// remoteCommand wraps a command so that its output and exit status can be
+// recovered from the interactive shell opened by the ssh action.
+type remoteCommand struct {
+	command     string
+	beginMarker string
+	endMarker   string
+}
+
+// newMarker returns a string that is unique to this session, to be printed
+// by the remote shell and recognised in its output.
+func newMarker(name string) (string, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return "MIST_" + name + "_" + strings.ToUpper(hex.EncodeToString(nonce)), nil
+}
+
+func newRemoteCommand(command string) (*remoteCommand, error) {
+	beginMarker, err := newMarker("BEGIN")
+	if err != nil {
+		return nil, err
+	}
+	endMarker, err := newMarker("END")
+	if err != nil {
+		return nil, err
+	}
+	return &remoteCommand{
+		command:     command,
+		beginMarker: beginMarker,
+		endMarker:   endMarker,
+	}, nil
+}
+
+// splitMarker quotes the two halves of a marker separately so that the
+// shell input echoed back by the remote terminal never matches it.
+func splitMarker(marker string) string {
+	return "'" + marker[:len(marker)/2] + "' '" + marker[len(marker)/2:] + "'"
+}
+
+// script returns the shell input that runs the command between the begin
+// and end markers and reports its exit status after the end marker. It is
+// sent as a single line, so that no prompts are printed in between, and
+// the command is encoded so that newlines or comments in it cannot break
+// that line.
+func (r *remoteCommand) script(withInput bool) string {
+	command := "eval \"$(printf '%s' '" + base64.StdEncoding.EncodeToString([]byte(r.command)) + "' | base64 -d)\""
+	if withInput {
+		// Make sure the input is consumed even if the command fails early,
+		// so that it is never interpreted by the shell, keeping the exit
+		// status of the command.
+		command += "; mist_status=$?; [ $mist_status -eq 0 ] || cat >/dev/null; (exit $mist_status)"
+	}
+	return "stty -echo -onlcr 2>/dev/null; printf '%s%s\\n' " + splitMarker(r.beginMarker) + "; " +
+		command + "; printf '%s%s%d\\n' " + splitMarker(r.endMarker) + " $?\n"
+}
+
+// remoteCommandOutput filters the shell output, forwarding only what the
+// command printed between the markers.
+type remoteCommandOutput struct {
+	cmd      *remoteCommand
+	out      io.Writer
+	buf      []byte
+	started  bool
+	finished bool
+	exitCode int
+}
+
+func (o *remoteCommandOutput) Write(p []byte) (int, error) {
+	if o.finished {
+		return len(p), nil
+	}
+	o.buf = append(o.buf, p...)
+	if !o.started {
+		i := bytes.Index(o.buf, []byte(o.cmd.beginMarker))
+		if i < 0 {
+			if keep := len(o.cmd.beginMarker) - 1; len(o.buf) > keep {
+				o.buf = append([]byte{}, o.buf[len(o.buf)-keep:]...)
+			}
+			return len(p), nil
+		}
+		j := bytes.IndexByte(o.buf[i:], '\n')
+		if j < 0 {
+			return len(p), nil
+		}
+		o.buf = append([]byte{}, o.buf[i+j+1:]...)
+		o.started = true
+	}
+	if i := bytes.Index(o.buf, []byte(o.cmd.endMarker)); i >= 0 {
+		status := o.buf[i+len(o.cmd.endMarker):]
+		j := bytes.IndexByte(status, '\n')
+		if j < 0 {
+			return len(p), nil
+		}
+		if _, err := o.out.Write(o.buf[:i]); err != nil {
+			return 0, err
+		}
+		exitCode, err := strconv.Atoi(strings.TrimSpace(string(status[:j])))
+		if err != nil {
+			return 0, fmt.Errorf("Could not parse exit status of remote command: %s", err)
+		}
+		o.exitCode = exitCode
+		o.finished = true
+		o.buf = nil
+		return len(p), nil
+	}
+	// Hold back enough bytes to detect an end marker split across messages.
+	if keep := len(o.cmd.endMarker) - 1; len(o.buf) > keep {
+		if _, err := o.out.Write(o.buf[:len(o.buf)-keep]); err != nil {
+			return 0, err
+		}
+		o.buf = append([]byte{}, o.buf[len(o.buf)-keep:]...)
+	}
+	return len(p), nil
+}
+
+// remoteInputChunkSize is the maximum size of a single stdin message.
+const remoteInputChunkSize = 32 * 1024
+
+func writeRemoteStdin(c *websocket.Conn, input []byte, writeMutex *sync.Mutex, writeWait time.Duration) error {
+	writeMutex.Lock()
+	c.SetWriteDeadline(time.Now().Add(writeWait))
+	err := c.WriteMessage(websocket.BinaryMessage, append([]byte{0}, input...))
+	writeMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("write: %s", err)
+	}
+	return nil
+}
+
+// sendRemoteCommand writes the command and its input to the remote shell.
+// The input is terminated by an EOT character, which the remote terminal
+// turns into an end of file.
+func sendRemoteCommand(c *websocket.Conn, cmd *remoteCommand, stdin io.Reader, writeMutex *sync.Mutex, writeWait time.Duration) error {
+	if err := writeRemoteStdin(c, []byte(cmd.script(stdin != nil)), writeMutex, writeWait); err != nil {
+		return err
+	}
+	if stdin == nil {
+		return nil
+	}
+	buf := make([]byte, remoteInputChunkSize)
+	lineStart := true
+	for {
+		n, err := stdin.Read(buf)
+		if n > 0 {
+			if err := writeRemoteStdin(c, buf[:n], writeMutex, writeWait); err != nil {
+				return err
+			}
+			lineStart = buf[n-1] == '\n'
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// An EOT in the middle of a line only flushes that line, so a second
+	// one is needed for the end of file.
+	eot := []byte{4}
+	if !lineStart {
+		eot = []byte{4, 4}
+	}
+	return writeRemoteStdin(c, eot, writeMutex, writeWait)
+}
+
+// readUntilMarker discards the output of the shell proxied by c until one
+// of the markers is printed, returning the index of that marker and any
+// output that followed the line it was printed on.
+func readUntilMarker(c *websocket.Conn, markers ...string) (int, []byte, error) {
+	var buf []byte
+	for {
+		mt, r, err := c.NextReader()
+		if err != nil {
+			return -1, nil, err
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return -1, nil, err
+		}
+		buf = append(buf, data...)
+		for index, marker := range markers {
+			i := bytes.Index(buf, []byte(marker))
+			if i < 0 {
+				continue
+			}
+			j := bytes.IndexByte(buf[i:], '\n')
+			if j < 0 {
+				break
+			}
+			return index, buf[i+j+1:], nil
+		}
+	}
+}
+
+// runRemoteCommand runs a command in the shell proxied by c, streams its
+// output to stdout and returns its exit status. If stdin is not nil, it
+// is fed to the command through the remote terminal, so it must consist
+// of newline terminated lines of text. The shell is left open, so more
+// commands can be run on the same connection.
+func runRemoteCommand(c *websocket.Conn, command string, stdin io.Reader, stdout io.Writer, writeMutex *sync.Mutex, writeWait time.Duration, pongWait time.Duration) (int, error) {
+	cmd, err := newRemoteCommand(command)
+	if err != nil {
+		return remoteCommandExitCode, err
+	}
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- sendRemoteCommand(c, cmd, stdin, writeMutex, writeWait)
+	}()
+	output := &remoteCommandOutput{cmd: cmd, out: stdout}
+	c.SetReadDeadline(time.Now().Add(pongWait))
+	c.SetPongHandler(func(string) error { c.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	for !output.finished {
+		mt, r, err := c.NextReader()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return remoteCommandExitCode, fmt.Errorf("%w: connection closed before the remote command completed", errConnectionLost)
+			}
+			return remoteCommandExitCode, fmt.Errorf("%w: %s", errConnectionLost, err)
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		if _, err := io.Copy(output, r); err != nil {
+			return remoteCommandExitCode, fmt.Errorf("%w: %s", errConnectionLost, err)
+		}
+	}
+	if err := <-sendErr; err != nil {
+		return remoteCommandExitCode, err
+	}
+	return output.exitCode, nil
+}
+
+// remoteShell is a shell to a machine that is used to run one or more
+// commands non-interactively.
+type remoteShell struct {
+	c          *websocket.Conn
+	writeMutex sync.Mutex
+	writeWait  time.Duration
+	pongWait   time.Duration
+	cancel     context.CancelFunc
+}
+
+func openRemoteShell(machine string) (*remoteShell, error) {
+	c, err := dialMachineShell(machine)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &remoteShell{c: c, writeWait: sessionWriteWait, pongWait: sessionPongWait, cancel: cancel}
+	// A lost connection is reported by the next read, so errors of the
+	// pings are not needed.
+	go sendPingMessages(ctx, c, make(chan error, 1), sessionWriteWait, sessionPingPeriod)
+	return s, nil
+}
+
+func (s *remoteShell) run(command string, stdin io.Reader, stdout io.Writer) (int, error) {
+	return runRemoteCommand(s.c, command, stdin, stdout, &s.writeMutex, s.writeWait, s.pongWait)
+}
+
+// output runs a command and returns its output, failing if the command
+// exits with a non-zero status.
+func (s *remoteShell) output(command string) (string, error) {
+	var out bytes.Buffer
+	exitCode, err := s.run(command, nil, &out)
+	if err != nil {
+		return "", err
+	}
+	if exitCode != 0 {
+		return "", fmt.Errorf("%s", strings.TrimSpace(out.String()))
+	}
+	return out.String(), nil
+}
+
+func (s *remoteShell) Close() error {
+	s.cancel()
+	return s.c.Close()
+}
+
+// runMachineCommand opens a shell to a machine, runs a command in it and
+// returns the command's exit status. The command reads an end of file from
+// stdin, instead of waiting for input that never comes.
+func runMachineCommand(machine, command string, stdout io.Writer) (int, error) {
+	s, err := openRemoteShell(machine)
+	if err != nil {
+		return remoteCommandExitCode, err
+	}
+	defer s.Close()
+	return s.run(command, strings.NewReader(""), stdout)
+}
+
+// prefixWriter prefixes every line written to it before passing it to
+// out. Writes of complete lines are serialized through mu so that output
+// of concurrent commands does not interleave mid-line.
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	mu     *sync.Mutex
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := w.writeLine(w.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// Flush writes out any trailing output that did not end in a newline.
+func (w *prefixWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.writeLine(append(w.buf, '\n'))
+	w.buf = nil
+	return err
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := fmt.Fprintf(w.out, "%s%s\n", w.prefix, bytes.TrimRight(line, "\r\n"))
+	return err
+}
+
+type machineRef struct {
+	id   string
+	name string
+}
+
+func listMachines(search string) ([]machineRef, error) {
+	params := viper.New()
+	params.Set("search", search)
+	params.Set("only", "id,name")
+	_, decoded, _, err := listAllPages(MistApiV2ListMachines, params)
+	if err != nil {
+		return nil, err
+	}
+	machines := []machineRef{}
+	items, _ := decoded["data"].([]interface{})
+	for _, item := range items {
+		machine, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, _ := machine["id"].(string)
+		name, _ := machine["name"].(string)
+		if id == "" {
+			continue
+		}
+		if name == "" {
+			name = id
+		}
+		machines = append(machines, machineRef{id: id, name: name})
+	}
+	return machines, nil
+}
+
+func execCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "exec --search QUERY -- COMMAND...",
+		Short: "Run a command on all machines matching a search filter",
+		Example: `  mist exec --search "tags:role=web AND state:running" -- uptime
+  mist exec --search "cloud:Linode" --parallel 20 -- "df -h /"`,
+		Args: cobra.MinimumNArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			command := strings.Join(args, " ")
+			search := params.GetString("search")
+			if search == "" {
+				logger.Fatal("The --search flag is required")
+			}
+			parallel := params.GetInt("parallel")
+			if parallel < 1 {
+				parallel = 1
+			}
+			machines, err := listMachines(search)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if len(machines) == 0 {
+				logger.Fatalf("No machines match %q", search)
+			}
+			width := 0
+			for _, machine := range machines {
+				if len(machine.name) > width {
+					width = len(machine.name)
+				}
+			}
+			var stdoutMutex sync.Mutex
+			results := make([]map[string]string, len(machines))
+			semaphore := make(chan struct{}, parallel)
+			var wg sync.WaitGroup
+			for i, machine := range machines {
+				wg.Add(1)
+				go func(i int, machine machineRef) {
+					defer wg.Done()
+					semaphore <- struct{}{}
+					defer func() { <-semaphore }()
+					out := &prefixWriter{prefix: fmt.Sprintf("%-*s | ", width, machine.name), out: os.Stdout, mu: &stdoutMutex}
+					exitCode, err := runMachineCommand(machine.id, command, out)
+					out.Flush()
+					result := map[string]string{
+						"id":        machine.id,
+						"name":      machine.name,
+						"exit_code": strconv.Itoa(exitCode),
+						"status":    "ok",
+						"error":     "",
+					}
+					if err != nil {
+						result["error"] = err.Error()
+					}
+					if err != nil || exitCode != 0 {
+						result["status"] = "failed"
+					}
+					results[i] = result
+				}(i, machine)
+			}
+			wg.Wait()
+			failed := 0
+			data := map[string][]interface{}{"data": {}}
+			for _, result := range results {
+				if result["status"] != "ok" {
+					failed++
+				}
+				data["data"] = append(data["data"], result)
+			}
+			fmt.Println("")
+			if err := cli.Formatter.Format(data, &viper.Viper{}, cli.CLIOutputOptions{[]string{"name", "status", "exit_code", "error"}, []string{"id", "name", "status", "exit_code", "error"}, []string{}, []string{}, map[string]string{}}); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+			if failed > 0 {
+				fmt.Fprintf(os.Stderr, "Command failed on %d of %d machines\n", failed, len(machines))
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().String("search", "", "Only run on machines matching search filter")
+	cmd.Flags().Int("parallel", 10, "Maximum number of machines to run the command on concurrently")
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// runScript runs the script of a remote command in a local shell, followed
+// by input, and returns the output of the command and its exit status.
+func runScript(t *testing.T, command, input string, withInput bool) (string, int) {
+	cmd, err := newRemoteCommand(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	output := &remoteCommandOutput{cmd: cmd, out: &out}
+	// Unlike other shells, bash reads a script from a pipe one byte at a
+	// time, so that the input is left to the command as with a terminal.
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not found")
+	}
+	sh := exec.Command(bash)
+	sh.Stdin = strings.NewReader(cmd.script(withInput) + input)
+	sh.Stdout = output
+	if err := sh.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !output.finished {
+		t.Fatal("no end marker in the output of the script")
+	}
+	return out.String(), output.exitCode
+}
+
+func TestRemoteCommandScriptExitStatus(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		command   string
+		input     string
+		withInput bool
+		output    string
+		exitCode  int
+	}{
+		{"no input", "echo out; sh -c 'exit 3'", "", false, "out\n", 3},
+		{"unread input", "sh -c 'exit 3'", "echo leaked\n", true, "", 3},
+		{"read input", "read x; echo got $x; sh -c 'exit 42'", "line\necho leaked\n", true, "got line\n", 42},
+		{"success", "cat", "a\nb\n", true, "a\nb\n", 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			output, exitCode := runScript(t, test.command, test.input, test.withInput)
+			if output != test.output {
+				t.Errorf("output %q, want %q", output, test.output)
+			}
+			if exitCode != test.exitCode {
+				t.Errorf("exit status %d, want %d", exitCode, test.exitCode)
+			}
+		})
+	}
+}
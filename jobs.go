@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/console"
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	terminal "golang.org/x/term"
+)
+
+const (
+	// Time allowed to write a message to the stream of a job.
+	jobStreamWriteWait = 10 * 3600 * time.Second
+
+	// Time allowed to read the next pong message from the stream of a job.
+	jobStreamPongWait = 20 * time.Second
+
+	// Send pings to the stream of a job with this period. Must be less
+	// than jobStreamPongWait.
+	jobStreamPingPeriod = (10 * time.Second * 9) / 10
+)
+
+// getJob returns the data of a job.
+func getJob(jobID string) (map[string]interface{}, error) {
+	_, decoded, _, err := MistApiV2GetJob(jobID, viper.New())
+	if err != nil {
+		return nil, err
+	}
+	data, ok := decoded["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("API response for job %s does not contain any data", jobID)
+	}
+	return data, nil
+}
+
+// jobError returns the error a job ended with, or an empty string if it
+// succeeded or has not finished yet.
+func jobError(job map[string]interface{}) string {
+	switch e := job["error"].(type) {
+	case string:
+		return e
+	case bool:
+		if !e {
+			return ""
+		}
+		// Look for the message in the log entry of the failure.
+		logs, _ := job["logs"].([]interface{})
+		for i := len(logs) - 1; i >= 0; i-- {
+			log, _ := logs[i].(map[string]interface{})
+			if message, ok := log["error"].(string); ok && message != "" {
+				return message
+			}
+		}
+		return "unknown error"
+	}
+	return ""
+}
+
+// dialJobStream opens the websocket that streams the log of a job.
+func dialJobStream(jobID string) (*websocket.Conn, error) {
+	job, err := getJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	location, ok := job["stream_uri"].(string)
+	if !ok {
+		return nil, fmt.Errorf("stream_uri not found in api response for job %s", jobID)
+	}
+	token, err := getToken()
+	if err != nil {
+		return nil, err
+	}
+	c, resp, err := dialWebsocket(location, http.Header{"Authorization": []string{token}})
+	if err != nil {
+		return nil, err
+	}
+	// Handle the case of redirections
+	if resp != nil && resp.StatusCode == 302 {
+		u, _ := resp.Location()
+		c, _, err = dialWebsocket(u.String(), http.Header{"Authorization": []string{token}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// streamJob copies the log streamed over c to out until the stream is
+// closed or ctx is done. It returns nil if the stream ended normally.
+func streamJob(ctx context.Context, c *websocket.Conn, out io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errc := make(chan error, 2)
+	go readFromRemoteStdout(c, out, errc, jobStreamPongWait)
+	go sendPingMessages(ctx, c, errc, jobStreamWriteWait, jobStreamPingPeriod)
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// finishedJobError returns an error if a job whose stream ended failed.
+func finishedJobError(jobID string) error {
+	job, err := getJob(jobID)
+	if err != nil {
+		return err
+	}
+	if message := jobError(job); message != "" {
+		return fmt.Errorf("Job %s failed: %s", jobID, message)
+	}
+	return nil
+}
+
+// followJob streams the log of a job to out until the job finishes and
+// returns an error if it failed. If both stdin and stdout are terminals,
+// streaming stops when any key is pressed, and nil is returned.
+func followJob(jobID string, out io.Writer) error {
+	c, err := dialJobStream(jobID)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Only use the terminal interactively if both ends of the stream are
+	// one, so that piping the output or running in CI works.
+	if terminal.IsTerminal(int(os.Stdin.Fd())) && terminal.IsTerminal(int(os.Stdout.Fd())) {
+		current := console.Current()
+		if err := current.SetRaw(); err != nil {
+			return err
+		}
+		terminal.NewTerminal(current, "")
+		defer current.Reset()
+
+		var writeMutex sync.Mutex
+		err = updateTerminalSize(c, &writeMutex, jobStreamWriteWait)
+		if err != nil {
+			return err
+		}
+		// Stop streaming when any key is pressed.
+		go func() {
+			bufio.NewReader(os.Stdin).ReadRune()
+			cancel()
+		}()
+	}
+
+	err = streamJob(ctx, c, out)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return finishedJobError(jobID)
+}
+
+// jobColors are the colours of the prefixes of the logs of multiple jobs.
+var jobColors = []string{"36", "32", "33", "35", "34", "31"}
+
+// followJobs streams the logs of multiple jobs to stdout, and to f if it
+// is not nil, prefixing each line with the job it belongs to. It returns
+// the result of each job once all have finished.
+func followJobs(jobIDs []string, f *os.File) []map[string]string {
+	width := 0
+	for _, jobID := range jobIDs {
+		if len(jobID) > width {
+			width = len(jobID)
+		}
+	}
+	color := terminal.IsTerminal(int(os.Stdout.Fd()))
+	var stdoutMutex, fileMutex sync.Mutex
+	results := make([]map[string]string, len(jobIDs))
+	var wg sync.WaitGroup
+	for i, jobID := range jobIDs {
+		wg.Add(1)
+		go func(i int, jobID string) {
+			defer wg.Done()
+			prefix := fmt.Sprintf("%-*s | ", width, jobID)
+			writers := []*prefixWriter{{prefix: prefix, out: os.Stdout, mu: &stdoutMutex}}
+			if color {
+				writers[0].prefix = "\x1b[" + jobColors[i%len(jobColors)] + "m" + prefix + "\x1b[0m"
+			}
+			if f != nil {
+				writers = append(writers, &prefixWriter{prefix: prefix, out: f, mu: &fileMutex})
+			}
+			out := []io.Writer{}
+			for _, w := range writers {
+				out = append(out, w)
+			}
+			c, err := dialJobStream(jobID)
+			if err == nil {
+				err = streamJob(context.Background(), c, io.MultiWriter(out...))
+				c.Close()
+			}
+			for _, w := range writers {
+				w.Flush()
+			}
+			result := map[string]string{
+				"job_id": jobID,
+				"status": "succeeded",
+				"error":  "",
+			}
+			if err == nil {
+				err = finishedJobError(jobID)
+			}
+			if err != nil {
+				result["status"] = "failed"
+				result["error"] = err.Error()
+			}
+			results[i] = result
+		}(i, jobID)
+	}
+	wg.Wait()
+	return results
+}
+
+// printJobResults prints the results of followJobs as a table and returns
+// the number of jobs that failed.
+func printJobResults(results []map[string]string) int {
+	failed := 0
+	data := map[string][]interface{}{"data": {}}
+	for _, result := range results {
+		if result["status"] != "succeeded" {
+			failed++
+		}
+		data["data"] = append(data["data"], result)
+	}
+	fmt.Println("")
+	if err := cli.Formatter.Format(data, &viper.Viper{}, cli.CLIOutputOptions{[]string{"job_id", "status", "error"}, []string{"job_id", "status", "error"}, []string{}, []string{}, map[string]string{}}); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+	return failed
+}
+
+// jobExitCode returns the exit status of the script run by a job, if it
+// has been logged.
+func jobExitCode(job map[string]interface{}) (int, bool) {
+	logs, _ := job["logs"].([]interface{})
+	for i := len(logs) - 1; i >= 0; i-- {
+		log, _ := logs[i].(map[string]interface{})
+		if exitCode, ok := log["exit_code"].(float64); ok {
+			return int(exitCode), true
+		}
+	}
+	return 0, false
+}
+
+// collectJobIDs returns the ids of the jobs in a decoded API response,
+// skipping the ones already seen.
+func collectJobIDs(v interface{}, seen map[string]bool) []string {
+	jobIDs := []string{}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if id, ok := value.(string); ok && (key == "job_id" || key == "jobId") {
+				if id != "" && !seen[id] {
+					seen[id] = true
+					jobIDs = append(jobIDs, id)
+				}
+			} else {
+				jobIDs = append(jobIDs, collectJobIDs(value, seen)...)
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			jobIDs = append(jobIDs, collectJobIDs(value, seen)...)
+		}
+	}
+	return jobIDs
+}
+
+// jobIDsFromRunOutput returns the ids of the jobs in the JSON output of one
+// or more runs, such as the output of "mist run script -o json".
+func jobIDsFromRunOutput(r io.Reader) ([]string, error) {
+	jobIDs := []string{}
+	seen := make(map[string]bool)
+	decoder := json.NewDecoder(r)
+	for {
+		var v interface{}
+		err := decoder.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse run output: %s", err)
+		}
+		jobIDs = append(jobIDs, collectJobIDs(v, seen)...)
+	}
+	return jobIDs, nil
+}
+
+// addRunScriptFollowFlag adds --follow to the generated run script command.
+// With it, the log of the started job is streamed and the CLI exits with
+// the exit status of the script.
+func addRunScriptFollowFlag() {
+	cmd, _, err := cli.Root.Find([]string{"run", "script"})
+	if err != nil || cmd.Name() != "script" {
+		return
+	}
+	run := cmd.Run
+	cmd.Flags().Bool("follow", false, "Stream the log of the script and exit with its exit status")
+	cmd.Example = strings.TrimLeft(cmd.Example+"\n  mist run script deploy --follow", "\n")
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if follow, _ := cmd.Flags().GetBool("follow"); !follow {
+			run(cmd, args)
+			return
+		}
+		params := viper.New()
+		params.BindPFlags(cmd.Flags())
+		body, err := cli.GetBody("application/json", args[1:], params.GetString("filename"))
+		if err != nil {
+			logger.Fatalf("Unable to get body: %s", err.Error())
+		}
+		_, decoded, _, err := MistApiV2RunScript(args[0], params, body)
+		if err != nil {
+			logger.Fatalf("Error calling operation: %s", err.Error())
+		}
+		jobIDs := collectJobIDs(decoded, make(map[string]bool))
+		switch len(jobIDs) {
+		case 0:
+			logger.Fatal("No job id found in the response of the run script operation")
+		case 1:
+			fmt.Fprintf(os.Stderr, "Started job %s\n", jobIDs[0])
+		default:
+			fmt.Fprintf(os.Stderr, "Started jobs %s\n", strings.Join(jobIDs, ", "))
+			if failed := printJobResults(followJobs(jobIDs, nil)); failed > 0 {
+				fmt.Fprintf(os.Stderr, "%d of %d jobs failed\n", failed, len(jobIDs))
+				os.Exit(1)
+			}
+			return
+		}
+		followErr := followJob(jobIDs[0], os.Stdout)
+		if followErr != nil {
+			fmt.Fprintln(os.Stderr, followErr)
+		}
+		exitCode := 0
+		if job, err := getJob(jobIDs[0]); err == nil {
+			exitCode, _ = jobExitCode(job)
+		}
+		if followErr != nil && exitCode == 0 {
+			exitCode = 1
+		}
+		os.Exit(exitCode)
+	}
+}
+
+// jobTime parses a time of a job, given in seconds since the epoch, which
+// is zero if it has not happened yet.
+func jobTime(v interface{}) (time.Time, bool) {
+	var seconds float64
+	switch v := v.(type) {
+	case float64:
+		seconds = v
+	case string:
+		var err error
+		seconds, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			t, err := time.Parse(time.RFC3339, v)
+			return t, err == nil
+		}
+	default:
+		return time.Time{}, false
+	}
+	if seconds <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true
+}
+
+// describeJob prints the status of a job and the timeline of the actions
+// in its log.
+func describeJob(w io.Writer, jobID string, job map[string]interface{}) {
+	started, hasStarted := jobTime(job["started_at"])
+	finished, hasFinished := jobTime(job["finished_at"])
+	logs, _ := job["logs"].([]interface{})
+	if !hasStarted && len(logs) > 0 {
+		log, _ := logs[0].(map[string]interface{})
+		started, hasStarted = jobTime(log["time"])
+	}
+	status := "running"
+	message := jobError(job)
+	if message != "" {
+		status = "failed"
+	} else if hasFinished {
+		status = "succeeded"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Job:\t%s\n", jobID)
+	fmt.Fprintf(tw, "Status:\t%s\n", status)
+	if hasStarted {
+		fmt.Fprintf(tw, "Started:\t%s\n", started.Format(time.RFC3339))
+	}
+	if hasFinished {
+		fmt.Fprintf(tw, "Finished:\t%s\n", finished.Format(time.RFC3339))
+		if hasStarted {
+			fmt.Fprintf(tw, "Duration:\t%s\n", finished.Sub(started).Round(time.Second))
+		}
+	}
+	if message != "" {
+		fmt.Fprintf(tw, "Error:\t%s\n", message)
+	}
+	if exitCode, ok := jobExitCode(job); ok {
+		fmt.Fprintf(tw, "Exit code:\t%d\n", exitCode)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Timeline:")
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "  TIME\tELAPSED\tACTION\tERROR")
+	for _, item := range logs {
+		log, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		at, elapsed := "", ""
+		if t, ok := jobTime(log["time"]); ok {
+			at = t.Format("15:04:05")
+			if hasStarted {
+				elapsed = "+" + t.Sub(started).Round(time.Second).String()
+			}
+		}
+		action, _ := log["action"].(string)
+		logError, _ := log["error"].(string)
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", at, elapsed, action, logError)
+	}
+	tw.Flush()
+}
+
+func describeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "describe",
+		Short: "Show details of a resource",
+	}
+	jobCmd := &cobra.Command{
+		Use:     "job JOB_ID",
+		Aliases: []string{"j", "jo", "jobs"},
+		Short:   "Show the status and the timeline of the actions of a job",
+		Example: `  mist describe job 2c7c1f4b6a8d4e0b9f3a5d6e7f8a9b0c`,
+		Args:    cobra.ExactArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			job, err := getJob(args[0])
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			describeJob(os.Stdout, args[0], job)
+		},
+	}
+	jobCmd.SetErr(os.Stderr)
+	cmd.AddCommand(jobCmd)
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
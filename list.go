@@ -0,0 +1,588 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	terminal "golang.org/x/term"
+	"gopkg.in/h2non/gentleman.v2"
+)
+
+type listController func(params *viper.Viper) (*gentleman.Response, map[string]interface{}, cli.CLIOutputOptions, error)
+
+// Default time between the polls of --watch.
+const watchDefaultInterval = 5 * time.Second
+
+// The largest page the list endpoints return, used by --all unless a
+// smaller --limit is given.
+const listMaxPageSize = 1000
+
+// listChange is a change in a listing between two polls of --watch.
+type listChange struct {
+	Type     string                 `json:"type"`
+	Time     string                 `json:"time"`
+	Resource map[string]interface{} `json:"resource"`
+	Fields   []string               `json:"fields,omitempty"`
+	key      string
+}
+
+// listRows returns the rows of a listing.
+func listRows(decoded map[string]interface{}) []map[string]interface{} {
+	rows := []map[string]interface{}{}
+	items, _ := decoded["data"].([]interface{})
+	for _, item := range items {
+		if row, ok := item.(map[string]interface{}); ok {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// rowKey returns the identity of a row of a listing.
+func rowKey(row map[string]interface{}) string {
+	for _, key := range []string{"id", "name"} {
+		if value, ok := row[key]; ok {
+			return fmt.Sprintf("%v", value)
+		}
+	}
+	j, _ := json.Marshal(row)
+	return string(j)
+}
+
+// rowName returns the name of a row of a listing, for display.
+func rowName(row map[string]interface{}) string {
+	if name, ok := row["name"].(string); ok && name != "" {
+		return name
+	}
+	return rowKey(row)
+}
+
+// diffRows returns the rows of current that were added or modified since
+// previous, followed by the rows of previous that were removed.
+func diffRows(previous map[string]map[string]interface{}, current []map[string]interface{}) []listChange {
+	now := time.Now().Format(time.RFC3339)
+	changes := []listChange{}
+	seen := make(map[string]bool)
+	for _, row := range current {
+		key := rowKey(row)
+		seen[key] = true
+		old, ok := previous[key]
+		if !ok {
+			changes = append(changes, listChange{Type: "added", Time: now, Resource: row, key: key})
+			continue
+		}
+		fields := []string{}
+		for field, value := range row {
+			if !reflect.DeepEqual(old[field], value) {
+				fields = append(fields, field)
+			}
+		}
+		for field := range old {
+			if _, ok := row[field]; !ok {
+				fields = append(fields, field)
+			}
+		}
+		if len(fields) > 0 {
+			sort.Strings(fields)
+			changes = append(changes, listChange{Type: "modified", Time: now, Resource: row, Fields: fields, key: key})
+		}
+	}
+	removed := []string{}
+	for key := range previous {
+		if !seen[key] {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+	for _, key := range removed {
+		changes = append(changes, listChange{Type: "removed", Time: now, Resource: previous[key], key: key})
+	}
+	return changes
+}
+
+// markRow returns a copy of row with its name prefixed by marker.
+func markRow(row map[string]interface{}, marker string) map[string]interface{} {
+	marked := make(map[string]interface{}, len(row))
+	for key, value := range row {
+		marked[key] = value
+	}
+	if name, ok := row["name"].(string); ok {
+		marked["name"] = marker + name
+	}
+	return marked
+}
+
+// renderWatch redraws a listing in place. In table output, it marks the
+// rows that were added (+), modified (~) or removed (-) since the previous
+// poll, and lists the changes below it. Other outputs are redrawn as they
+// are, so that they can still be parsed.
+func renderWatch(header string, decoded map[string]interface{}, changes []listChange, table bool, params *viper.Viper, outputOptions cli.CLIOutputOptions) {
+	if !table {
+		changes = nil
+	}
+	byKey := make(map[string]listChange)
+	for _, change := range changes {
+		byKey[change.key] = change
+	}
+	markers := map[string]string{"added": "+ ", "modified": "~ ", "removed": "- "}
+	data := []interface{}{}
+	for _, row := range listRows(decoded) {
+		marker := "  "
+		if change, ok := byKey[rowKey(row)]; ok {
+			marker = markers[change.Type]
+		}
+		if len(changes) == 0 {
+			marker = ""
+		}
+		data = append(data, markRow(row, marker))
+	}
+	for _, change := range changes {
+		if change.Type == "removed" {
+			data = append(data, markRow(change.Resource, markers[change.Type]))
+		}
+	}
+	marked := make(map[string]interface{}, len(decoded))
+	for key, value := range decoded {
+		marked[key] = value
+	}
+	marked["data"] = data
+
+	// Clear the screen and move the cursor to its top left.
+	fmt.Print("\x1b[H\x1b[2J")
+	fmt.Println(header)
+	fmt.Println("")
+	if err := cli.Formatter.Format(marked, params, outputOptions); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+	if len(changes) == 0 {
+		return
+	}
+	colors := map[string]string{"added": "32", "modified": "33", "removed": "31"}
+	fmt.Println("")
+	for _, change := range changes {
+		line := change.Type + " " + rowName(change.Resource)
+		if len(change.Fields) > 0 {
+			line += ": " + strings.Join(change.Fields, ", ")
+		}
+		fmt.Printf("\x1b[%sm%s%s\x1b[0m\n", colors[change.Type], markers[change.Type], line)
+	}
+}
+
+// watchList polls a listing until interrupted. On a terminal the listing
+// is redrawn in place, otherwise each change is printed as a JSON event.
+func watchList(command string, list listController, table bool, params *viper.Viper) {
+	interval := params.GetDuration("watch-interval")
+	if interval <= 0 {
+		interval = watchDefaultInterval
+	}
+	tty := terminal.IsTerminal(int(os.Stdout.Fd()))
+	encoder := json.NewEncoder(os.Stdout)
+	var previous map[string]map[string]interface{}
+	for {
+		resp, decoded, outputOptions, err := list(params)
+		if err != nil {
+			if !isRetryable(resp, err) {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			fmt.Fprintf(os.Stderr, "Error calling operation: %s\n", err.Error())
+		} else {
+			rows := listRows(decoded)
+			changes := diffRows(previous, rows)
+			if tty {
+				if previous == nil {
+					changes = nil
+				}
+				header := fmt.Sprintf("Every %s: %s    %s", interval, command, time.Now().Format("15:04:05"))
+				renderWatch(header, decoded, changes, table, params, outputOptions)
+			} else {
+				for _, change := range changes {
+					if err := encoder.Encode(change); err != nil {
+						logger.Fatal(err)
+					}
+				}
+			}
+			previous = make(map[string]map[string]interface{}, len(rows))
+			for _, row := range rows {
+				previous[rowKey(row)] = row
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// listPages requests the pages of a listing, starting at --start and
+// requesting --limit rows per page, and calls page with each of them and
+// the number of rows returned before it. When the listing has a
+// meta.total, pages are requested until that many rows were returned, so
+// that pages shorter than requested do not end the listing early. On a
+// terminal the progress is shown on stderr. It returns the response and
+// the output options of the last page and the first row requested.
+func listPages(list listController, params *viper.Viper, page func(decoded map[string]interface{}, before int) error) (*gentleman.Response, cli.CLIOutputOptions, int, error) {
+	var outputOptions cli.CLIOutputOptions
+	start := 0
+	if value := params.GetString("start"); value != "" {
+		var err error
+		start, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, outputOptions, 0, fmt.Errorf("Invalid start %q, --all requires a numeric start", value)
+		}
+	}
+	pageSize := params.GetInt64("limit")
+	if pageSize <= 0 || pageSize > listMaxPageSize {
+		pageSize = listMaxPageSize
+	}
+	pageParams := viper.New()
+	for key, value := range params.AllSettings() {
+		pageParams.Set(key, value)
+	}
+	progress := terminal.IsTerminal(int(os.Stderr.Fd()))
+	clearProgress := func() {
+		if progress {
+			fmt.Fprint(os.Stderr, "\r\x1b[K")
+		}
+	}
+	var resp *gentleman.Response
+	returned := 0
+	for {
+		pageParams.Set("start", strconv.Itoa(start+returned))
+		pageParams.Set("limit", pageSize)
+		var decoded map[string]interface{}
+		var err error
+		resp, decoded, outputOptions, err = list(pageParams)
+		if err != nil {
+			clearProgress()
+			return resp, outputOptions, start, err
+		}
+		items, _ := decoded["data"].([]interface{})
+		clearProgress()
+		if err := page(decoded, returned); err != nil {
+			return resp, outputOptions, start, err
+		}
+		returned += len(items)
+		meta, _ := decoded["meta"].(map[string]interface{})
+		total, hasTotal := meta["total"].(float64)
+		if progress && hasTotal {
+			fmt.Fprintf(os.Stderr, "Fetched %d of %d", returned, int(total)-start)
+		}
+		if len(items) == 0 || hasTotal && float64(start+returned) >= total || !hasTotal && int64(len(items)) < pageSize {
+			break
+		}
+	}
+	clearProgress()
+	return resp, outputOptions, start, nil
+}
+
+// listAllPages requests all the pages of a listing with listPages. The rows
+// of all pages are merged into the first page, whose meta is updated to
+// cover them.
+func listAllPages(list listController, params *viper.Viper) (*gentleman.Response, map[string]interface{}, cli.CLIOutputOptions, error) {
+	var decoded map[string]interface{}
+	rows := []interface{}{}
+	resp, outputOptions, start, err := listPages(list, params, func(page map[string]interface{}, before int) error {
+		if decoded == nil {
+			decoded = page
+		}
+		items, _ := page["data"].([]interface{})
+		rows = append(rows, items...)
+		return nil
+	})
+	if err != nil {
+		return resp, nil, outputOptions, err
+	}
+	decoded["data"] = rows
+	decoded["meta"] = mergedMeta(decoded, start, len(rows))
+	return resp, decoded, outputOptions, nil
+}
+
+// mergedMeta returns the meta of the first page of a listing, updated to
+// cover the returned rows from start.
+func mergedMeta(first map[string]interface{}, start, returned int) map[string]interface{} {
+	meta := make(map[string]interface{})
+	if firstMeta, ok := first["meta"].(map[string]interface{}); ok {
+		for key, value := range firstMeta {
+			meta[key] = value
+		}
+	}
+	meta["start"] = start
+	meta["returned"] = returned
+	return meta
+}
+
+// jsonListWriter writes a listing as a JSON document, writing the rows of
+// each page as it arrives. The document is the same as the merged listing
+// of listAllPages.
+type jsonListWriter struct {
+	out   io.Writer
+	first map[string]interface{}
+}
+
+// marshalIndented encodes v as indented JSON, nested at depth.
+func marshalIndented(v interface{}, depth int) ([]byte, error) {
+	return json.MarshalIndent(v, strings.Repeat("  ", depth), "  ")
+}
+
+// writeFields writes the fields of the first page for which include is
+// true, each preceded by before and followed by after.
+func (w *jsonListWriter) writeFields(include func(key string) bool, before, after string) error {
+	keys := make([]string, 0, len(w.first))
+	for key := range w.first {
+		if include(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name, _ := json.Marshal(key)
+		value, err := marshalIndented(w.first[key], 1)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w.out, "%s  %s: %s%s", before, name, value, after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *jsonListWriter) page(decoded map[string]interface{}, before int) error {
+	if w.first == nil {
+		w.first = decoded
+		if _, err := fmt.Fprint(w.out, "{\n"); err != nil {
+			return err
+		}
+		if err := w.writeFields(func(key string) bool { return key < "data" }, "", ",\n"); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprint(w.out, "  \"data\": ["); err != nil {
+			return err
+		}
+	}
+	items, _ := decoded["data"].([]interface{})
+	for i, item := range items {
+		row, err := marshalIndented(item, 2)
+		if err != nil {
+			return err
+		}
+		separator := ",\n    "
+		if before+i == 0 {
+			separator = "\n    "
+		}
+		if _, err := fmt.Fprintf(w.out, "%s%s", separator, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close writes the end of the document, with the fields of the first page
+// that follow data and the meta of the merged listing.
+func (w *jsonListWriter) close(start, returned int) error {
+	if w.first == nil {
+		return nil
+	}
+	closing := "\n  ]"
+	if returned == 0 {
+		closing = "]"
+	}
+	if _, err := fmt.Fprint(w.out, closing); err != nil {
+		return err
+	}
+	w.first["meta"] = mergedMeta(w.first, start, returned)
+	if err := w.writeFields(func(key string) bool { return key > "data" }, ",\n", ""); err != nil {
+		return err
+	}
+	_, err := fmt.Fprint(w.out, "\n}\n")
+	return err
+}
+
+// csvListWriter writes the rows of a listing as CSV, writing the rows of
+// each page as it arrives. The columns are the JSON pointers of the fields
+// of the rows of the first page, and the values of nested objects and
+// arrays are flattened into their own columns.
+type csvListWriter struct {
+	w       *csv.Writer
+	columns []string
+}
+
+// flattenRow adds the values of the fields of a row to fields, by their
+// JSON pointer.
+func flattenRow(value interface{}, pointer string, fields map[string]string) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			key = strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+			flattenRow(field, pointer+"/"+key, fields)
+		}
+	case []interface{}:
+		for i, item := range value {
+			flattenRow(item, pointer+"/"+strconv.Itoa(i), fields)
+		}
+	case nil:
+		fields[pointer] = ""
+	case float64:
+		fields[pointer] = strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		fields[pointer] = fmt.Sprintf("%v", value)
+	}
+}
+
+func (w *csvListWriter) page(decoded map[string]interface{}, before int) error {
+	items, _ := decoded["data"].([]interface{})
+	rows := make([]map[string]string, 0, len(items))
+	for _, item := range items {
+		fields := make(map[string]string)
+		flattenRow(item, "", fields)
+		rows = append(rows, fields)
+	}
+	if w.columns == nil {
+		seen := make(map[string]bool)
+		for _, fields := range rows {
+			for column := range fields {
+				if !seen[column] {
+					seen[column] = true
+					w.columns = append(w.columns, column)
+				}
+			}
+		}
+		if len(w.columns) == 0 {
+			return nil
+		}
+		sort.Strings(w.columns)
+		if err := w.w.Write(w.columns); err != nil {
+			return err
+		}
+	}
+	for _, fields := range rows {
+		record := make([]string, len(w.columns))
+		for i, column := range w.columns {
+			record[i] = fields[column]
+		}
+		if err := w.w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// streamAllPages requests all the pages of a listing with listPages and
+// writes the rows of each page to out as it arrives, in format, which is
+// json or csv.
+func streamAllPages(list listController, params *viper.Viper, format string, out io.Writer) error {
+	if format == "csv" {
+		writer := &csvListWriter{w: csv.NewWriter(out)}
+		_, _, _, err := listPages(list, params, writer.page)
+		return err
+	}
+	writer := &jsonListWriter{out: out}
+	returned := 0
+	_, _, start, err := listPages(list, params, func(decoded map[string]interface{}, before int) error {
+		items, _ := decoded["data"].([]interface{})
+		returned = before + len(items)
+		return writer.page(decoded, before)
+	})
+	if err != nil {
+		return err
+	}
+	return writer.close(start, returned)
+}
+
+// streamFormat returns the format in which a listing is written with
+// streamAllPages, if its output is json or csv and not queried with -q,
+// whose queries need the whole listing.
+func streamFormat(cmd *cobra.Command) (string, bool) {
+	if flag := cmd.Flags().ShorthandLookup("q"); flag != nil && flag.Value.String() != "" {
+		return "", false
+	}
+	flag := cmd.Flags().ShorthandLookup("o")
+	if flag == nil {
+		return "", false
+	}
+	switch format := flag.Value.String(); format {
+	case "json", "csv":
+		return format, true
+	}
+	return "", false
+}
+
+// tableOutput returns whether the output of a command is a table: when
+// neither -q nor -o with another format is given.
+func tableOutput(cmd *cobra.Command) bool {
+	if flag := cmd.Flags().ShorthandLookup("q"); flag != nil && flag.Changed && flag.Value.String() != "" {
+		return false
+	}
+	if flag := cmd.Flags().ShorthandLookup("o"); flag != nil && flag.Changed && flag.Value.String() != "table" {
+		return false
+	}
+	return true
+}
+
+// listAll returns whether all the pages of a listing should be requested:
+// when --all is given, or by default when the output is not a table.
+func listAll(cmd *cobra.Command) bool {
+	if flag := cmd.Flags().Lookup("all"); flag != nil && flag.Changed {
+		all, _ := cmd.Flags().GetBool("all")
+		return all
+	}
+	return !tableOutput(cmd)
+}
+
+// addListFlags adds --watch and --all to the generated commands that list
+// the resources of resourceListControllersMap.
+func addListFlags() {
+	for resource, list := range resourceListControllersMap {
+		list := list
+		cmd, _, err := cli.Root.Find([]string{"get", resource})
+		if err != nil || cmd.Name() != resource {
+			continue
+		}
+		cmd.Flags().Bool("watch", false, "Keep polling and show changes to the listing (Only for listings)")
+		cmd.Flags().Duration("watch-interval", watchDefaultInterval, "Time between polls of --watch (Only for listings)")
+		cmd.Flags().Bool("all", false, "Request all the pages of the listing, default for non-table outputs (Only for listings)")
+		run := cmd.Run
+		cmd.Run = func(cmd *cobra.Command, args []string) {
+			watch, _ := cmd.Flags().GetBool("watch")
+			all := listAll(cmd)
+			if len(args) > 0 || !watch && !all {
+				run(cmd, args)
+				return
+			}
+			params := viper.New()
+			params.BindPFlags(cmd.Flags())
+			if watch {
+				watched := list
+				if all {
+					watched = func(params *viper.Viper) (*gentleman.Response, map[string]interface{}, cli.CLIOutputOptions, error) {
+						return listAllPages(list, params)
+					}
+				}
+				watchList(cmd.CommandPath(), watched, tableOutput(cmd), params)
+				return
+			}
+			if format, ok := streamFormat(cmd); ok {
+				if err := streamAllPages(list, params, format, os.Stdout); err != nil {
+					logger.Fatalf("Error calling operation: %s", err.Error())
+				}
+				return
+			}
+			_, decoded, outputOptions, err := listAllPages(list, params)
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+				logger.Fatalf("Formatting failed: %s", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/h2non/gentleman.v2"
+)
+
+// pagedList returns a listController of total rows that returns at most
+// maxPage rows per page, whatever the requested limit, and counts its
+// calls.
+func pagedList(total, maxPage int, calls *int) listController {
+	return func(params *viper.Viper) (*gentleman.Response, map[string]interface{}, cli.CLIOutputOptions, error) {
+		*calls++
+		start, _ := strconv.Atoi(params.GetString("start"))
+		limit := int(params.GetInt64("limit"))
+		if limit > maxPage {
+			limit = maxPage
+		}
+		data := []interface{}{}
+		for i := start; i < total && i < start+limit; i++ {
+			data = append(data, map[string]interface{}{
+				"id":   fmt.Sprintf("id-%d", i),
+				"name": fmt.Sprintf("machine-%d", i),
+				"cost": map[string]interface{}{"hourly": float64(i) / 2},
+				"tags": []interface{}{"a", "b"},
+			})
+		}
+		return nil, map[string]interface{}{
+			"data": data,
+			"meta": map[string]interface{}{"start": float64(start), "returned": float64(len(data)), "total": float64(total), "sort": ""},
+		}, cli.CLIOutputOptions{}, nil
+	}
+}
+
+func TestListAllPagesShortPages(t *testing.T) {
+	calls := 0
+	params := viper.New()
+	params.Set("start", "3")
+	// The server returns at most 4 rows per page, fewer than requested.
+	_, decoded, _, err := listAllPages(pagedList(25, 4, &calls), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := len(listRows(decoded)); rows != 22 {
+		t.Fatalf("%d rows, want 22", rows)
+	}
+	if calls != 6 {
+		t.Fatalf("%d calls, want 6", calls)
+	}
+	meta := decoded["meta"].(map[string]interface{})
+	if meta["start"] != 3 || meta["returned"] != 22 {
+		t.Fatalf("meta %v", meta)
+	}
+}
+
+func TestStreamAllPagesJSON(t *testing.T) {
+	for _, total := range []int{0, 1, 7} {
+		calls := 0
+		params := viper.New()
+		params.Set("limit", 3)
+		var out bytes.Buffer
+		if err := streamAllPages(pagedList(total, 3, &calls), params, "json", &out); err != nil {
+			t.Fatal(err)
+		}
+		_, decoded, _, err := listAllPages(pagedList(total, 3, &calls), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := json.MarshalIndent(decoded, "", "  ")
+		if out.String() != string(want)+"\n" {
+			t.Errorf("%d rows: got\n%s\nwant\n%s", total, out.String(), want)
+		}
+	}
+}
+
+func TestStreamAllPagesCSV(t *testing.T) {
+	calls := 0
+	params := viper.New()
+	params.Set("limit", 1)
+	var out bytes.Buffer
+	if err := streamAllPages(pagedList(2, 1, &calls), params, "csv", &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "/cost/hourly,/id,/name,/tags/0,/tags/1\n0,id-0,machine-0,a,b\n0.5,id-1,machine-1,a,b\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
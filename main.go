@@ -1,20 +1,19 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
 	"sync"
-	"time"
+	"syscall"
 
 	"github.com/containerd/console"
-	"github.com/gorilla/websocket"
 	"github.com/jmespath/go-jmespath"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -191,10 +190,15 @@ func versionCmd() *cobra.Command {
 }
 
 func sshCmd() *cobra.Command {
+	params := viper.New()
 	cmd := &cobra.Command{
-		Use:   "ssh",
-		Short: "Open a shell to a machine",
-		Args:  cobra.ExactValidArgs(1),
+		Use:   "ssh MACHINE [-- COMMAND...]",
+		Short: "Open a shell to a machine or run a command on it",
+		Example: `  mist ssh machine-name
+  mist ssh machine-name -- uptime
+  mist ssh machine-name -- "systemctl status nginx | head"
+  ssh -o ProxyCommand="mist ssh --stdio %h" user@machine-name`,
+		Args: cobra.MinimumNArgs(1),
 		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 
 			if len(args) == 0 {
@@ -215,241 +219,269 @@ func sshCmd() *cobra.Command {
 		},
 		Run: func(cmd *cobra.Command, args []string) {
 			machine := args[0]
-			// Time allowed to write a message to the peer.
-			writeWait := 2 * time.Second
-
-			// Time allowed to read the next pong message from the peer.
-			pongWait := 10 * time.Second
-
-			// Send pings to peer with this period. Must be less than pongWait.
-			pingPeriod := (pongWait * 9) / 10
-
-			err := setContext()
-			if err != nil {
-				logger.Fatalf("Could not set context %s", err)
-			}
-			server, err := getServer()
-			if err != nil {
-				logger.Fatal(err)
-			}
-			if !strings.HasSuffix(server, "/") {
-				server = server + "/"
-			}
-			if !strings.HasPrefix(server, "http") {
-				server = "http://" + server
-			}
-			path := server + "api/v2/machines/" + machine + "/actions/ssh"
-			client := &http.Client{
-				CheckRedirect: func(req *http.Request, via []*http.Request) error {
-					return http.ErrUseLastResponse
-				}}
-			req, err := http.NewRequest("POST", path, nil)
-			if err != nil {
-				logger.Fatal(err)
-			}
-			token, err := getToken()
-			if err != nil {
-				logger.Fatal(err)
-			}
-			req.Header.Add("Authorization", token)
-			if err != nil {
-				logger.Fatal(err)
-			}
-			resp, err := client.Do(req)
-			if err != nil {
-				logger.Fatal(err)
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode/100 != 3 {
-				logger.Fatalf("Could not SSH into machine: %s", resp.Status)
+			command := strings.Join(args[1:], " ")
+			if params.GetBool("stdio") {
+				// stdout carries the ssh protocol, so errors go to stderr.
+				if params.GetString("record") != "" {
+					fmt.Fprintln(os.Stderr, "--record can not be used with --stdio, which relays the encrypted ssh protocol")
+					os.Exit(1)
+				}
+				if err := bridgeStdio(machine); err != nil {
+					exitSession(err)
+				}
+				return
 			}
-			_, err = ioutil.ReadAll(resp.Body)
+
+			escapeChar, escapes, err := parseEscapeChar(params.GetString("escape-char"))
 			if err != nil {
 				logger.Fatal(err)
 			}
-			location := resp.Header.Get("location")
-			c, resp, err := websocket.DefaultDialer.Dial(location, http.Header{"Authorization": []string{token}})
+
+			c, err := dialMachineShell(machine)
 			if err != nil {
-				logger.Fatal(err)
+				exitSession(err)
 			}
-			// Handle the case of redirections
-			if resp != nil && resp.StatusCode == 302 {
-				u, _ := resp.Location()
-				c, resp, err = websocket.DefaultDialer.Dial(u.String(), http.Header{"Authorization": []string{token}})
-				if err != nil || resp.StatusCode/100 != 2 {
-					logger.Fatal(err)
+			defer c.Close()
+
+			if record := params.GetString("record"); record != "" {
+				title := "mist ssh " + machine
+				if command != "" {
+					title += " -- " + command
+				}
+				sessionRecorder, err = newAsciicastRecorder(record, title)
+				if err != nil {
+					logger.Fatalf("Could not record session: %s", err)
+				}
+				defer sessionRecorder.Close()
+			}
+
+			if command != "" {
+				ctx, cancel := context.WithCancel(context.Background())
+				var writeMutex sync.Mutex
+				// Input that is redirected is forwarded to the command.
+				// Otherwise the command reads an end of file right away,
+				// instead of waiting for input that never comes.
+				var stdin io.Reader = os.Stdin
+				if terminal.IsTerminal(int(os.Stdin.Fd())) {
+					err = updateTerminalSize(c, &writeMutex, sessionWriteWait)
+					if err != nil {
+						exitSession(err)
+					}
+					stdin = strings.NewReader("")
 				}
+				go sendPingMessages(ctx, c, make(chan error, 1), sessionWriteWait, sessionPingPeriod)
+				exitCode, err := runRemoteCommand(c, command, stdin, sessionStdout(), &writeMutex, sessionWriteWait, sessionPongWait)
+				cancel()
+				c.Close()
+				// Deferred calls do not run on exit.
+				sessionRecorder.Close()
+				if err != nil {
+					exitSession(err)
+				}
+				os.Exit(exitCode)
 			}
-			defer c.Close()
+
 			current := console.Current()
 			if err := current.SetRaw(); err != nil {
 				logger.Fatal(err)
 			}
 			terminal.NewTerminal(current, "")
 			defer current.Reset()
-			done := make(chan bool)
-
-			var writeMutex sync.Mutex
 
-			err = updateTerminalSize(c, &writeMutex, writeWait)
+			// Buffered, so that stdin keeps being read while a message is
+			// sent and queued input can be coalesced.
+			input := make(chan []byte, 64)
+			go readLocalStdin(input)
+			var sessionInput <-chan []byte = input
+			if escapes {
+				sessionConnection.machine = machine
+				sessionInput = filterEscapes(input, escapeChar)
+			}
+
+			// The terminal is raw, so Ctrl-C is sent to the remote shell,
+			// but the session still ends cleanly on signals sent to mist.
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			if params.GetBool("reconnect") {
+				err = runReconnectingShellSession(ctx, machine, c, sessionInput, sessionWriteWait, sessionPongWait, sessionPingPeriod)
+			} else {
+				err = runShellSession(ctx, c, sessionInput, sessionWriteWait, sessionPongWait, sessionPingPeriod)
+			}
 			if err != nil {
-				logger.Fatal(err)
+				// Deferred calls do not run on exit.
+				current.Reset()
+				sessionRecorder.Close()
+				c.Close()
+				exitSession(err)
 			}
-
-			go handleTerminalResize(c, &done, &writeMutex, writeWait)
-			go readFromRemoteStdout(c, &done, pongWait)
-			go writeToRemoteStdin(c, &done, &writeMutex, writeWait)
-			go sendPingMessages(c, &done, writeWait, pingPeriod)
-
-			<-done
 		},
 	}
+	cmd.Flags().Bool("reconnect", false, "Reconnect automatically if the connection is lost")
+	cmd.Flags().String("record", "", "Record the session to FILE in asciicast v2 format")
+	cmd.Flags().StringP("escape-char", "e", "~", "Escape character for escape sequences such as ~. to disconnect, or none to disable them")
+	cmd.Flags().Bool("stdio", false, "Relay stdin and stdout to the machine's ssh server, for use as an OpenSSH ProxyCommand")
+	params.BindPFlags(cmd.Flags())
+	cmd.AddCommand(sshReplayCmd())
 	cmd.SetErr(os.Stderr)
 	return cmd
 }
 
 func streamingCmd() *cobra.Command {
+	params := viper.New()
 	cmd := &cobra.Command{
-		Use:   "stream JOB_ID",
+		Use:   "stream JOB_ID...",
 		Short: "Stream logs of a running script",
-		Args:  cobra.ExactValidArgs(1),
+		Long: `Stream the logs of one or more jobs until they finish. The CLI exits with a
+  non-zero status if any job ended with an error.
+
+  The logs of multiple jobs are streamed together, with each line prefixed
+  by its job, followed by a summary of the jobs that succeeded or failed.
+  The jobs can also be read from the JSON output of "mist run" with
+  --from-run. When streaming a single job in a terminal, press any key to
+  stop streaming.`,
+		Example: `  mist stream 2c7c1f4b6a8d4e0b9f3a5d6e7f8a9b0c
+  mist stream 2c7c1f4b6a8d4e0b9f3a5d6e7f8a9b0c --output job.log
+  mist run script deploy -o json | mist stream --from-run -`,
 		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 			return nil, cobra.ShellCompDirectiveNoFileComp
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			job_id := args[0]
-			// Time allowed to write a message to the peer.
-			writeWait := 10 * 3600 * time.Second
-
-			// Time allowed to read the next pong message from the peer.
-			pongWait := 20 * time.Second
-
-			// Send pings to peer with this period. Must be less than pongWait.
-			pingPeriod := (10 * time.Second * 9) / 10
-
-			server, err := getServer()
-			if err != nil {
-				logger.Println(err)
-				return
-			}
-			if !strings.HasSuffix(server, "/") {
-				server = server + "/"
-			}
-			if !strings.HasPrefix(server, "http") {
-				server = "http://" + server
-			}
-			path := server + "api/v2/jobs/" + job_id
-			client := &http.Client{
-				CheckRedirect: func(req *http.Request, via []*http.Request) error {
-					return http.ErrUseLastResponse
-				}}
-			req, err := http.NewRequest("GET", path, nil)
-			if err != nil {
-				logger.Println(err)
-				return
-			}
-			token, err := getToken()
-			if err != nil {
-				logger.Println(err)
-				return
-			}
-			req.Header.Add("Authorization", token)
-			if err != nil {
-				logger.Println(err)
-				return
-			}
-			resp, err := client.Do(req)
-			if err != nil {
-				logger.Println(err)
-				return
-			}
-			var r any
-			decoder := json.NewDecoder(resp.Body)
-			err = decoder.Decode(&r)
-			if err != nil {
-				logger.Println(err)
-				return
-			}
-			data, data_exists := r.(map[string]any)["data"]
-			var location string
-			if data_exists {
-				_, ok := data.(map[string]any)["stream_uri"].(string)
-				if !ok {
-					logger.Fatal(errors.New("stream_uri not found in api response for given JOB_ID"))
-					return
+			jobIDs := args
+			if fromRun := params.GetString("from-run"); fromRun != "" {
+				var r io.Reader = os.Stdin
+				if fromRun != "-" {
+					f, err := os.Open(fromRun)
+					if err != nil {
+						logger.Fatal(err)
+					}
+					defer f.Close()
+					r = f
 				}
-				location = data.(map[string]any)["stream_uri"].(string)
-			} else {
-				logger.Fatal(errors.New("api response for given JOB_ID does not contain any data"))
-			}
-			defer resp.Body.Close()
-			c, resp, err := websocket.DefaultDialer.Dial(location, http.Header{"Authorization": []string{token}})
-			if err != nil {
-				logger.Println(err)
-				return
-			}
-			if resp != nil && resp.StatusCode == 302 {
-				u, _ := resp.Location()
-				c, resp, err = websocket.DefaultDialer.Dial(u.String(), http.Header{"Authorization": []string{token}})
+				runJobIDs, err := jobIDsFromRunOutput(r)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				jobIDs = append(jobIDs, runJobIDs...)
 			}
-			defer c.Close()
-			if err != nil {
-				logger.Println(err)
-				return
+			if len(jobIDs) == 0 {
+				logger.Fatal("No jobs to stream, pass one or more JOB_IDs or --from-run")
 			}
 
-			current := console.Current()
-			if err := current.SetRaw(); err != nil {
-				panic(err)
+			var f *os.File
+			if output := params.GetString("output"); output != "" {
+				var err error
+				f, err = os.Create(output)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				defer f.Close()
 			}
-			terminal.NewTerminal(current, "")
-			defer current.Reset()
-			done := make(chan bool)
-
-			var writeMutex sync.Mutex
 
-			err = updateTerminalSize(c, &writeMutex, writeWait)
-			if err != nil {
-				logger.Println(err)
+			if len(jobIDs) == 1 {
+				var out io.Writer = os.Stdout
+				if f != nil {
+					out = io.MultiWriter(os.Stdout, f)
+				}
+				if err := followJob(jobIDs[0], out); err != nil {
+					// Deferred calls do not run on exit.
+					if f != nil {
+						f.Close()
+					}
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
 				return
 			}
-			go func() {
-				cmd.InOrStdin()
-				_, _, err := bufio.NewReader(cmd.InOrStdin()).ReadRune()
-				if err != nil {
-					logger.Println(err)
-					return
+
+			if failed := printJobResults(followJobs(jobIDs, f)); failed > 0 {
+				if f != nil {
+					f.Close()
 				}
-				done <- true
-				os.Exit(0)
-			}()
-			go readFromRemoteStdout(c, &done, pongWait)
-			go sendPingMessages(c, &done, writeWait, pingPeriod)
-			<-done
+				fmt.Fprintf(os.Stderr, "%d of %d jobs failed\n", failed, len(jobIDs))
+				os.Exit(1)
+			}
 		},
 	}
+	cmd.Flags().String("output", "", "Also save the log to FILE")
+	cmd.Flags().String("from-run", "", "Stream the jobs in the JSON output of mist run saved in FILE, or - for stdin")
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
 	cmd.SetErr(os.Stderr)
 	return cmd
 }
 
 func getResourceMeterCmdRun(params *viper.Viper, resource string, detailedName bool) {
-	dtStart := params.GetString("start")
-	if dtStart == "" {
-		dtStart = fmt.Sprintf("%d", (time.Now()).Unix()-60*60)
+	if err := parseGroupBy(params.GetString("group-by")); err != nil {
+		logger.Fatal(err)
+	}
+	dtStart, dtEnd, err := parseTimeRange(params.GetString("start"), params.GetString("end"))
+	if err != nil {
+		logger.Fatal(err)
 	}
-	dtEnd := params.GetString("end")
-	if dtEnd == "" {
-		dtEnd = fmt.Sprintf("%d", (time.Now()).Unix())
+	groupBy := params.GetString("group-by")
+	if step := params.GetString("step"); step != "" {
+		if params.GetBool("cost") {
+			logger.Fatal("--step can not be combined with --cost")
+		}
+		stepDuration, err := parseStep(step)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		search := params.GetString("search")
+		metricsSet, resourceSeries, times := getMeteringSeries(resource, dtStart, dtEnd, stepDuration, search)
+		resourceNames := getResourceNamesIDMap(resource, search)
+		if detailedName {
+			for resourceID, name := range resourceNames {
+				resourceNames[resourceID] = resource + "/" + name
+			}
+		}
+		var rows map[string]map[string]interface{}
+		if groupBy != "" {
+			rows = getResourceRows(resource, search)
+		}
+		formatMeteringSeries(metricsSet, resourceSeries, times, resourceNames, groupBy, rows)
+		return
+	}
+	_, resourceMetricsStart, _, err := getMeteringData(dtStart, dtEnd, resource, params.GetString("search"), fmt.Sprintf("first_over_time({metering=\"true\",%s_id=~\".+\"}", resource)+"[%ds])")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	metricsSet, resourceMetricsEnd, resourceNames, err := getMeteringData(dtStart, dtEnd, resource, params.GetString("search"), fmt.Sprintf("last_over_time({metering=\"true\",%s_id=~\".+\"}", resource)+"[%ds])")
+	if err != nil {
+		logger.Fatal(err)
 	}
-	_, resourceMetricsStart, _ := getMeteringData(dtStart, dtEnd, params.GetString("search"), fmt.Sprintf("first_over_time({metering=\"true\",%s_id=~\".+\"}", resource)+"[%ds])")
-	metricsSet, resourceMetricsEnd, resourceNames := getMeteringData(dtStart, dtEnd, params.GetString("search"), fmt.Sprintf("last_over_time({metering=\"true\",%s_id=~\".+\"}", resource)+"[%ds])")
 	if detailedName {
 		for resourceID, name := range resourceNames {
 			resourceNames[resourceID] = resource + "/" + name
 		}
 	}
 	machineMetricsGauges := calculateDiffs(resourceMetricsStart, resourceMetricsEnd, metricsSet)
-	formatMeteringData(metricsSet, machineMetricsGauges, resourceNames)
+	if params.GetBool("cost") {
+		costs := getResourceCosts(resource, params.GetString("search"))
+		if len(costs) == 0 {
+			if detailedName {
+				return
+			}
+			logger.Fatalf("No cost information for %ss", resource)
+		}
+		// With mist meter all, types without the counter are charged for
+		// the whole time range.
+		usageMetric := params.GetString("usage-metric")
+		if err := checkUsageMetric(usageMetric, metricsSet); err != nil && !detailedName {
+			logger.Fatal(err)
+		}
+		formatCostData(getCostRows(machineMetricsGauges, costs, usageMetric, dtEnd.Sub(dtStart).Hours()), groupBy)
+		return
+	}
+	if groupBy != "" {
+		formatGroupedMeteringData(groupBy, metricsSet, machineMetricsGauges, getResourceRows(resource, params.GetString("search")))
+		return
+	}
+	formatMeteringData(resource, metricsSet, machineMetricsGauges, resourceNames)
 }
 
 func getResourceMeterCmd(resource string, aliasesMap map[string][]string, detailedName bool) *cobra.Command {
@@ -463,9 +495,13 @@ func getResourceMeterCmd(resource string, aliasesMap map[string][]string, detail
 			getResourceMeterCmdRun(params, resource, false)
 		},
 	}
-	cmd.Flags().String("start", "", "start <rfc3339 | unix_timestamp>")
-	cmd.Flags().String("end", "", "end <rfc3339 | unix_timestamp>")
+	cmd.Flags().String("start", "", "start <rfc3339 | unix_timestamp | date | -7d | now-1h | yesterday | last-month>")
+	cmd.Flags().String("end", "", "end <rfc3339 | unix_timestamp | date | now | yesterday | last-month>")
 	cmd.Flags().String("search", "", "Only return results matching search filter")
+	cmd.Flags().Bool("cost", false, "Show the estimated spend of the resources over the time range, from their hourly or monthly cost")
+	cmd.Flags().String("usage-metric", "", "Counter of the seconds each resource was running, to charge with --cost instead of the whole time range")
+	cmd.Flags().String("group-by", "", "Sum the data per cloud, owner or tag:<key>")
+	cmd.Flags().String("step", "", "Split the time range in steps, such as 1h or 1d, and show the data of each step")
 
 	cli.SetCustomFlags(cmd)
 
@@ -475,7 +511,7 @@ func getResourceMeterCmd(resource string, aliasesMap map[string][]string, detail
 	return cmd
 }
 
-func getAllResourcesMeterCmd(resources []string, aliasesMap map[string][]string) *cobra.Command {
+func getAllResourcesMeterCmd(aliasesMap map[string][]string) *cobra.Command {
 	params := viper.New()
 	cmd := &cobra.Command{
 		Use:     "all",
@@ -483,6 +519,14 @@ func getAllResourcesMeterCmd(resources []string, aliasesMap map[string][]string)
 		Short:   "Get metering data for all resources",
 		Args:    cobra.ExactValidArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
+			dtStart, dtEnd, err := parseTimeRange(params.GetString("start"), params.GetString("end"))
+			if err != nil {
+				logger.Fatal(err)
+			}
+			resources, err := getMeteredResources(dtStart, dtEnd, params.GetString("search"))
+			if err != nil {
+				logger.Fatal(err)
+			}
 			for i, resource := range resources {
 				getResourceMeterCmdRun(params, resource, true)
 				if i != len(resources)-1 {
@@ -491,9 +535,13 @@ func getAllResourcesMeterCmd(resources []string, aliasesMap map[string][]string)
 			}
 		},
 	}
-	cmd.Flags().String("start", "", "start <rfc3339 | unix_timestamp>")
-	cmd.Flags().String("end", "", "end <rfc3339 | unix_timestamp>")
+	cmd.Flags().String("start", "", "start <rfc3339 | unix_timestamp | date | -7d | now-1h | yesterday | last-month>")
+	cmd.Flags().String("end", "", "end <rfc3339 | unix_timestamp | date | now | yesterday | last-month>")
 	cmd.Flags().String("search", "", "Only return results matching search filter")
+	cmd.Flags().Bool("cost", false, "Show the estimated spend of the resources over the time range, from their hourly or monthly cost")
+	cmd.Flags().String("usage-metric", "", "Counter of the seconds each resource was running, to charge with --cost instead of the whole time range")
+	cmd.Flags().String("group-by", "", "Sum the data per cloud, owner or tag:<key>")
+	cmd.Flags().String("step", "", "Split the time range in steps, such as 1h or 1d, and show the data of each step")
 
 	cli.SetCustomFlags(cmd)
 
@@ -528,7 +576,8 @@ func meterCmd() *cobra.Command {
 			return nil, cobra.ShellCompDirectiveNoFileComp
 		},
 	}
-	resources := []string{"machine", "volume"}
+	resources := append([]string{}, meteredResources...)
+	sort.Strings(resources)
 	resourcesTrie := trie.New()
 	aliasesMap := make(map[string][]string)
 	for _, resource := range append(resources, []string{"all"}...) {
@@ -544,7 +593,7 @@ func meterCmd() *cobra.Command {
 	for _, resource := range resources {
 		cmd.AddCommand(getResourceMeterCmd(resource, aliasesMap, false))
 	}
-	cmd.AddCommand(getAllResourcesMeterCmd(resources, aliasesMap))
+	cmd.AddCommand(getAllResourcesMeterCmd(aliasesMap))
 	cmd.SetErr(os.Stderr)
 	return cmd
 }
@@ -560,6 +609,10 @@ func main() {
 	// Initialize the API key authentication.
 	apikey.Init("Authorization", apikey.LocationHeader)
 
+	// Retry, rate limit and time out the API requests as configured in the
+	// current context.
+	cli.Client.Use(apiClientPlugin())
+
 	// Add command groups
 	/*cli.Root.AddGroup(&cobra.Group{Group: "clouds", Title: "  # CLOUDS"})
 	cli.Root.AddGroup(&cobra.Group{Group: "machines", Title: "  # MACHINES"})
@@ -579,13 +632,44 @@ func main() {
 	// Register auto-generated commands
 	mistApiV2Register(false)
 
+	// Add --follow to the run script command
+	addRunScriptFollowFlag()
+
+	// Add --timeout and --interval to the commands waiting for jobs
+	replaceJobFinishedWaiter()
+
+	// Add waiters for resources to the wait command
+	addResourceWaiters()
+
+	// Accept relative times and periods in the datapoints command
+	addDatapointsTimeParsing()
+
+	// Add --watch and --all to the list commands
+	addListFlags()
+
 	// Add version command
 	cli.Root.AddCommand(versionCmd())
 
 	// Add ssh command
 	cli.Root.AddCommand(sshCmd())
 
+	// Add ssh-config command
+	cli.Root.AddCommand(sshConfigCmd())
+
+	// Add exec command
+	cli.Root.AddCommand(execCmd())
+
+	// Add cp command
+	cli.Root.AddCommand(cpCmd())
+
+	// Add port-forward command
+	cli.Root.AddCommand(portForwardCmd())
+
 	cli.Root.AddCommand(streamingCmd())
+
+	// Add describe command
+	cli.Root.AddCommand(describeCmd())
+
 	// Add metering command
 	cli.Root.AddCommand(meterCmd())
 
@@ -595,5 +679,11 @@ func main() {
 
 	cli.Root.AddCommand(kubeconfigCmd())
 
+	// Added last, so that it can be checked against the flags of all the
+	// commands.
+	if err := addVerboseFlag(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not add -v: %s\n", err)
+	}
+
 	cli.Root.Execute()
 }
@@ -4,11 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
 )
@@ -16,6 +19,7 @@ import (
 type resultItem struct {
 	Metric map[string]string `json:"metric"`
 	Value  []interface{}     `json:"value"`
+	Values [][]interface{}   `json:"values"`
 }
 
 type promqlResponse struct {
@@ -27,26 +31,27 @@ type promqlResponse struct {
 	Metadata map[string]interface{}
 }
 
-func formatMeteringData(metricsSet map[string]string, resourceMetrics map[string]map[string]string, resourceNames map[string]string) {
+func formatMeteringData(resource string, metricsSet map[string]string, resourceMetrics map[string]map[string]string, resourceNames map[string]string) {
+	idColumn := resource + "_id"
 	metricsList := []string{}
 	for metric := range metricsSet {
 		metricsList = append(metricsList, metric)
 	}
 	sort.Strings(metricsList)
 	resources := make([]string, 0, len(resourceMetrics))
-	for resource := range resourceMetrics {
-		resources = append(resources, resource)
+	for resourceID := range resourceMetrics {
+		resources = append(resources, resourceID)
 	}
 	sort.Strings(resources)
 	data := make(map[string][]interface{})
-	for _, resource := range resources {
+	for _, resourceID := range resources {
 		resourceData := make(map[string]string)
 		for _, metric := range metricsList {
-			if _, ok := resourceData["machine_id"]; !ok {
-				resourceData["machine_id"] = resource
-				resourceData["name"] = resourceNames[resource]
+			if _, ok := resourceData[idColumn]; !ok {
+				resourceData[idColumn] = resourceID
+				resourceData["name"] = resourceNames[resourceID]
 			}
-			resourceData[metric] = resourceMetrics[resource][metric]
+			resourceData[metric] = resourceMetrics[resourceID][metric]
 		}
 		if _, ok := data["data"]; !ok {
 			data["data"] = make([]interface{}, 0)
@@ -73,93 +78,827 @@ func formatMeteringData(metricsSet map[string]string, resourceMetrics map[string
 	for i, metric := range metricsList {
 		sums[i] = fmt.Sprintf("%f", metricSums[metric])
 	}
-	if err := cli.Formatter.Format(data, &viper.Viper{}, cli.CLIOutputOptions{append([]string{"name"}, metricsList...), append([]string{"machine_id", "name"}, metricsList...), append([]string{"TOTAL"}, sums...), append([]string{"TOTAL", ""}, sums...), map[string]string{}}); err != nil {
+	if err := cli.Formatter.Format(data, &viper.Viper{}, cli.CLIOutputOptions{append([]string{"name"}, metricsList...), append([]string{idColumn, "name"}, metricsList...), append([]string{"TOTAL"}, sums...), append([]string{"TOTAL", ""}, sums...), map[string]string{}}); err != nil {
 		logger.Fatalf("Formatting failed: %s", err.Error())
 	}
 }
 
-func parseTime(s string) (time.Time, error) {
-	if t, err := strconv.ParseFloat(s, 64); err == nil {
-		s, ns := math.Modf(t)
-		return time.Unix(int64(s), int64(ns*float64(time.Second))).UTC(), nil
+// formatGroupedMeteringData prints the metering data of the resources
+// summed per group of --group-by.
+func formatGroupedMeteringData(groupBy string, metricsSet map[string]string, resourceMetrics map[string]map[string]string, rows map[string]map[string]interface{}) {
+	metricsList := []string{}
+	for metric := range metricsSet {
+		metricsList = append(metricsList, metric)
 	}
-	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
-		return t, nil
+	sort.Strings(metricsList)
+	groupSums := make(map[string]map[string]float64)
+	groupResources := make(map[string]int)
+	metricSums := make(map[string]float64)
+	for resource, metrics := range resourceMetrics {
+		group := groupKey(rows[resource], groupBy)
+		if groupSums[group] == nil {
+			groupSums[group] = make(map[string]float64)
+		}
+		groupResources[group]++
+		for _, metric := range metricsList {
+			valueString, ok := metrics[metric]
+			if !ok || valueString == "" {
+				continue
+			}
+			value, err := strconv.ParseFloat(valueString, 64)
+			if err != nil {
+				fmt.Printf("metric: %s, value: %s\n", metric, valueString)
+				fmt.Println(err)
+				continue
+			}
+			groupSums[group][metric] += value
+			metricSums[metric] += value
+		}
+	}
+	groups := make([]string, 0, len(groupSums))
+	for group := range groupSums {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	column := groupByColumn(groupBy)
+	data := map[string][]interface{}{"data": {}}
+	for _, group := range groups {
+		groupData := map[string]string{
+			column:      group,
+			"resources": strconv.Itoa(groupResources[group]),
+		}
+		for _, metric := range metricsList {
+			groupData[metric] = fmt.Sprintf("%f", groupSums[group][metric])
+		}
+		data["data"] = append(data["data"], groupData)
+	}
+	sums := []string{"TOTAL", strconv.Itoa(len(resourceMetrics))}
+	for _, metric := range metricsList {
+		sums = append(sums, fmt.Sprintf("%f", metricSums[metric]))
+	}
+	cols := append([]string{column, "resources"}, metricsList...)
+	if err := cli.Formatter.Format(data, &viper.Viper{}, cli.CLIOutputOptions{cols, cols, sums, sums, map[string]string{}}); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
 	}
-	return time.Time{}, errors.Errorf("cannot parse %q to a valid timestamp", s)
 }
 
-func getResourceNamesIDMap(search string) map[string]string {
-	resourceNames := make(map[string]string)
+// Hours in a month, to estimate the hourly cost of resources that only have
+// a monthly cost.
+const hoursPerMonth = 730
+
+// resourceCost is the cost of a metered resource.
+type resourceCost struct {
+	name    string
+	cloud   string
+	hourly  float64
+	monthly float64
+	row     map[string]interface{}
+}
+
+// Group of the resources that have no value for the --group-by dimension.
+const meteringNoGroup = "(none)"
+
+// refName returns the name of a resource referenced by a field of another,
+// which is either its name or id or the resource itself.
+func refName(ref interface{}) string {
+	switch ref := ref.(type) {
+	case string:
+		return ref
+	case map[string]interface{}:
+		return rowName(ref)
+	case nil:
+		return ""
+	}
+	return fmt.Sprintf("%v", ref)
+}
+
+// parseGroupBy validates the value of --group-by.
+func parseGroupBy(groupBy string) error {
+	switch {
+	case groupBy == "", groupBy == "cloud", groupBy == "owner":
+		return nil
+	case strings.HasPrefix(groupBy, "tag:") && len(groupBy) > len("tag:"):
+		return nil
+	}
+	return errors.Errorf("Invalid group by %q, expected cloud, owner or tag:<key>", groupBy)
+}
+
+// groupByColumn returns the column of the groups of --group-by.
+func groupByColumn(groupBy string) string {
+	return strings.TrimPrefix(groupBy, "tag:")
+}
+
+// tagValue returns the value of the tag key of a resource, whose tags are
+// either a map, a list of key/value maps or a comma separated string.
+func tagValue(tags interface{}, key string) (string, bool) {
+	switch tags := tags.(type) {
+	case map[string]interface{}:
+		if value, ok := tags[key]; ok {
+			if value == nil {
+				return "", true
+			}
+			return fmt.Sprintf("%v", value), true
+		}
+	case []interface{}:
+		for _, tag := range tags {
+			if tag, ok := tag.(map[string]interface{}); ok && tag["key"] == key {
+				if tag["value"] == nil {
+					return "", true
+				}
+				return fmt.Sprintf("%v", tag["value"]), true
+			}
+		}
+	case string:
+		for _, tag := range strings.Split(tags, ",") {
+			tagKey, value, _ := strings.Cut(strings.TrimSpace(tag), "=")
+			if tagKey == key {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// groupKey returns the group of a resource for --group-by.
+func groupKey(row map[string]interface{}, groupBy string) string {
+	var group string
+	switch {
+	case row == nil:
+	case groupBy == "cloud":
+		group = refName(row["cloud"])
+	case groupBy == "owner":
+		group = refName(row["owned_by"])
+	case strings.HasPrefix(groupBy, "tag:"):
+		group, _ = tagValue(row["tags"], strings.TrimPrefix(groupBy, "tag:"))
+	}
+	if group == "" {
+		return meteringNoGroup
+	}
+	return group
+}
+
+// getResourceRows returns the resources of a type that match search by id.
+func getResourceRows(resource, search string) map[string]map[string]interface{} {
+	rows := make(map[string]map[string]interface{})
+	list, ok := resourceListControllersMap[resource]
+	if !ok {
+		return rows
+	}
 	paramsListResources := viper.New()
 	paramsListResources.Set("search", search)
-	_, decoded, _, err := MistApiV2ListMachines(paramsListResources)
+	_, decoded, _, err := listAllPages(list, paramsListResources)
 	if err != nil {
 		logger.Fatalf("Error calling operation: %s", err.Error())
 	}
-	for _, item := range decoded["data"].([]interface{}) {
-		resourceNames[item.(map[string]interface{})["id"].(string)] = item.(map[string]interface{})["name"].(string)
+	for _, row := range listRows(decoded) {
+		if id, ok := row["id"].(string); ok {
+			rows[id] = row
+		}
+	}
+	return rows
+}
+
+// getResourceCosts returns the cost of the resources of a type that match
+// search by id, from the cost.hourly and cost.monthly fields of their
+// listing.
+func getResourceCosts(resource, search string) map[string]resourceCost {
+	costs := make(map[string]resourceCost)
+	for id, row := range getResourceRows(resource, search) {
+		cost, ok := row["cost"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		hourly, _ := cost["hourly"].(float64)
+		monthly, _ := cost["monthly"].(float64)
+		if hourly == 0 {
+			hourly = monthly / hoursPerMonth
+		}
+		costs[id] = resourceCost{
+			name:    rowName(row),
+			cloud:   refName(row["cloud"]),
+			hourly:  hourly,
+			monthly: monthly,
+			row:     row,
+		}
+	}
+	return costs
+}
+
+// Basis of the spend of a resource that is charged for the whole time
+// range, when no --usage-metric is given or the resource has no data for it.
+const costBasisRange = "range"
+
+// checkUsageMetric returns an error if usageMetric, the value of
+// --usage-metric, is not one of the counters of the metering data.
+func checkUsageMetric(usageMetric string, metricsSet map[string]string) error {
+	if usageMetric == "" || metricsSet[usageMetric] == "counter" {
+		return nil
+	}
+	counters := []string{}
+	for metric, valueType := range metricsSet {
+		if valueType == "counter" {
+			counters = append(counters, metric)
+		}
+	}
+	sort.Strings(counters)
+	return errors.Errorf("Invalid usage metric %q, expected one of the counters of the metering data: %s", usageMetric, strings.Join(counters, ", "))
+}
+
+// usageHours returns the hours a resource was running during a time range of
+// at most rangeHours, from the increase of the counter usageMetric in its
+// metering diffs of calculateDiffs. The counter is in seconds, the base unit
+// of time of metering series. It returns false if the resource has no value
+// for the counter, or if the counter was reset.
+func usageHours(diffs map[string]string, usageMetric string, rangeHours float64) (float64, bool) {
+	if usageMetric == "" {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(diffs[usageMetric], 64)
+	if err != nil || value < 0 {
+		return 0, false
+	}
+	hours := value / 3600
+	if hours > rangeHours {
+		hours = rangeHours
+	}
+	return hours, true
+}
+
+// costRow is the estimated spend of a resource over a time range.
+type costRow struct {
+	resource string
+	cost     resourceCost
+	hours    float64
+	basis    string
+	spend    float64
+}
+
+// getCostRows joins the metering diffs of the resources with their costs by
+// id, charging each resource for the hours of usageMetric when it is given
+// and for the whole time range of rangeHours otherwise. The rows are sorted
+// by name.
+func getCostRows(resourceMetrics map[string]map[string]string, costs map[string]resourceCost, usageMetric string, rangeHours float64) []costRow {
+	rows := []costRow{}
+	for resource, diffs := range resourceMetrics {
+		cost, ok := costs[resource]
+		if !ok {
+			continue
+		}
+		hours, ok := usageHours(diffs, usageMetric, rangeHours)
+		basis := usageMetric
+		if !ok {
+			hours, basis = rangeHours, costBasisRange
+		}
+		rows = append(rows, costRow{resource: resource, cost: cost, hours: hours, basis: basis, spend: cost.hourly * hours})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].cost.name != rows[j].cost.name {
+			return rows[i].cost.name < rows[j].cost.name
+		}
+		return rows[i].resource < rows[j].resource
+	})
+	return rows
+}
+
+// formatCostData prints the estimated spend of the cost rows of
+// getCostRows, per resource and per group of --group-by, by default per
+// cloud.
+func formatCostData(rows []costRow, groupBy string) {
+	if groupBy == "" {
+		groupBy = "cloud"
+	}
+	data := map[string][]interface{}{"data": {}}
+	groupCosts := make(map[string]float64)
+	groupResources := make(map[string]int)
+	total := 0.0
+	for _, row := range rows {
+		data["data"] = append(data["data"], map[string]string{
+			"id":      row.resource,
+			"name":    row.cost.name,
+			"cloud":   row.cost.cloud,
+			"hourly":  fmt.Sprintf("%.4f", row.cost.hourly),
+			"monthly": fmt.Sprintf("%.2f", row.cost.monthly),
+			"hours":   fmt.Sprintf("%.2f", row.hours),
+			"basis":   row.basis,
+			"cost":    fmt.Sprintf("%.2f", row.spend),
+		})
+		group := groupKey(row.cost.row, groupBy)
+		groupCosts[group] += row.spend
+		groupResources[group]++
+		total += row.spend
+	}
+	sum := fmt.Sprintf("%.2f", total)
+	if err := cli.Formatter.Format(data, &viper.Viper{}, cli.CLIOutputOptions{[]string{"name", "cloud", "hourly", "hours", "basis", "cost"}, []string{"id", "name", "cloud", "hourly", "monthly", "hours", "basis", "cost"}, []string{"TOTAL", "", "", "", "", sum}, []string{"TOTAL", "", "", "", "", "", "", sum}, map[string]string{}}); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+
+	groups := make([]string, 0, len(groupCosts))
+	for group := range groupCosts {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	column := groupByColumn(groupBy)
+	groupData := map[string][]interface{}{"data": {}}
+	for _, group := range groups {
+		groupData["data"] = append(groupData["data"], map[string]string{
+			column:      group,
+			"resources": strconv.Itoa(groupResources[group]),
+			"cost":      fmt.Sprintf("%.2f", groupCosts[group]),
+		})
+	}
+	fmt.Println("")
+	if err := cli.Formatter.Format(groupData, &viper.Viper{}, cli.CLIOutputOptions{[]string{column, "resources", "cost"}, []string{column, "resources", "cost"}, []string{"TOTAL", strconv.Itoa(len(rows)), sum}, []string{"TOTAL", strconv.Itoa(len(rows)), sum}, map[string]string{}}); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+}
+
+// parseStep parses the value of --step, a duration that may also be given
+// in days or weeks, such as 1d or 2w.
+func parseStep(s string) (time.Duration, error) {
+	step, err := parseDuration(s)
+	if err != nil || step < time.Second {
+		return 0, errors.Errorf("Invalid step %q, expected a duration such as 1h or 1d", s)
+	}
+	return step, nil
+}
+
+// meteringSeries are the values of the metrics of a resource at each step
+// of a time range, by metric and index of the step.
+type meteringSeries map[string]map[int]float64
+
+// getMeteringSeries returns the metrics and the metering data of the
+// resources of a type at each step from start to end, which is extended to
+// a whole number of steps. It also returns the times of the steps.
+func getMeteringSeries(resource string, start, end time.Time, step time.Duration, search string) (map[string]string, map[string]meteringSeries, []time.Time) {
+	steps := int(math.Ceil(float64(end.Sub(start)) / float64(step)))
+	if steps < 1 {
+		steps = 1
 	}
-	_, decoded, _, err = MistApiV2ListVolumes(paramsListResources)
+	times := make([]time.Time, steps+1)
+	for i := range times {
+		times[i] = start.Add(time.Duration(i) * step)
+	}
+	paramsGetDatapoints := viper.New()
+	paramsGetDatapoints.Set("start", strconv.FormatInt(start.Unix(), 10))
+	paramsGetDatapoints.Set("end", strconv.FormatInt(times[steps].Unix(), 10))
+	paramsGetDatapoints.Set("step", strconv.FormatInt(int64(step.Seconds()), 10))
+	paramsGetDatapoints.Set("search", search)
+	query := fmt.Sprintf("last_over_time({metering=\"true\",%s_id=~\".+\"}[%ds])", resource, int64(step.Seconds()))
+	_, decoded, _, err := MistApiV2GetDatapoints(query, paramsGetDatapoints)
 	if err != nil {
 		logger.Fatalf("Error calling operation: %s", err.Error())
 	}
-	for _, item := range decoded["data"].([]interface{}) {
-		resourceNames[item.(map[string]interface{})["id"].(string)] = item.(map[string]interface{})["name"].(string)
+
+	rawResponse, err := json.Marshal(decoded)
+	if err != nil {
+		fmt.Println("error:", err)
+	}
+
+	var response promqlResponse
+	err = json.Unmarshal(rawResponse, &response)
+	if err != nil {
+		fmt.Println("error:", err)
+	}
+
+	metricsSet := make(map[string]string)
+	resourceSeries := make(map[string]meteringSeries)
+	for _, item := range response.Data.DataPromql.Result {
+		seriesType, resourceID, ok := seriesResource(item.Metric)
+		if !ok || seriesType != resource {
+			continue
+		}
+		metric := item.Metric["__name__"]
+		metricsSet[metric] = item.Metric["value_type"]
+		if resourceSeries[resourceID] == nil {
+			resourceSeries[resourceID] = make(meteringSeries)
+		}
+		if resourceSeries[resourceID][metric] == nil {
+			resourceSeries[resourceID][metric] = make(map[int]float64)
+		}
+		for _, point := range item.Values {
+			if len(point) != 2 {
+				continue
+			}
+			timestamp, ok := point[0].(float64)
+			if !ok {
+				continue
+			}
+			valueString, _ := point[1].(string)
+			value, err := strconv.ParseFloat(valueString, 64)
+			if err != nil {
+				continue
+			}
+			i := int(math.Round((timestamp - float64(start.Unix())) / step.Seconds()))
+			resourceSeries[resourceID][metric][i] += value
+		}
+	}
+	return metricsSet, resourceSeries, times
+}
+
+// stepValue returns the value of a series at the end of step i, or its
+// increase during the step if it is a counter. It returns false if the
+// series has no datapoint at the end of the step or, for a counter, at its
+// start, such as after a gap in the data, so that the whole value of the
+// counter is not shown as the usage of the step.
+func stepValue(series map[int]float64, i int, counter bool) (float64, bool) {
+	value, ok := series[i]
+	if !ok {
+		return 0, false
+	}
+	if counter {
+		previous, ok := series[i-1]
+		if !ok {
+			return 0, false
+		}
+		value -= previous
+	}
+	return value, true
+}
+
+// formatMeteringSeries prints the metering data of the resources for each
+// step of a time range, one row per step and resource, or per step and
+// group of --group-by. Counters are the difference from the previous step
+// and gauges the value at the end of the step. Values missing as found by
+// stepValue are left empty.
+func formatMeteringSeries(metricsSet map[string]string, resourceSeries map[string]meteringSeries, times []time.Time, resourceNames map[string]string, groupBy string, rows map[string]map[string]interface{}) {
+	metricsList := []string{}
+	for metric := range metricsSet {
+		metricsList = append(metricsList, metric)
+	}
+	sort.Strings(metricsList)
+	resources := make([]string, 0, len(resourceSeries))
+	for resource := range resourceSeries {
+		resources = append(resources, resource)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		if resourceNames[resources[i]] != resourceNames[resources[j]] {
+			return resourceNames[resources[i]] < resourceNames[resources[j]]
+		}
+		return resources[i] < resources[j]
+	})
+	column := "name"
+	if groupBy != "" {
+		column = groupByColumn(groupBy)
+	}
+	data := map[string][]interface{}{"data": {}}
+	metricSums := make(map[string]float64)
+	for i := 1; i < len(times); i++ {
+		keys := []string{}
+		sums := make(map[string]map[string]float64)
+		for _, resource := range resources {
+			key := resource
+			if groupBy != "" {
+				key = groupKey(rows[resource], groupBy)
+			}
+			values := make(map[string]float64)
+			for _, metric := range metricsList {
+				if value, ok := stepValue(resourceSeries[resource][metric], i, metricsSet[metric] == "counter"); ok {
+					values[metric] = value
+				}
+			}
+			if len(values) == 0 {
+				continue
+			}
+			if sums[key] == nil {
+				sums[key] = make(map[string]float64)
+				keys = append(keys, key)
+			}
+			for metric, value := range values {
+				sums[key][metric] += value
+				metricSums[metric] += value
+			}
+		}
+		if groupBy != "" {
+			sort.Strings(keys)
+		}
+		for _, key := range keys {
+			stepData := map[string]string{"time": times[i-1].UTC().Format(time.RFC3339)}
+			if groupBy == "" {
+				stepData["id"] = key
+				stepData["name"] = resourceNames[key]
+			} else {
+				stepData[column] = key
+			}
+			for _, metric := range metricsList {
+				if value, ok := sums[key][metric]; ok {
+					stepData[metric] = fmt.Sprintf("%f", value)
+				}
+			}
+			data["data"] = append(data["data"], stepData)
+		}
+	}
+	sums := []string{}
+	for _, metric := range metricsList {
+		sums = append(sums, fmt.Sprintf("%f", metricSums[metric]))
+	}
+	cols := append([]string{"time", column}, metricsList...)
+	wideCols := cols
+	totals := append([]string{"TOTAL", ""}, sums...)
+	wideTotals := totals
+	if groupBy == "" {
+		wideCols = append([]string{"time", "id", "name"}, metricsList...)
+		wideTotals = append([]string{"TOTAL", "", ""}, sums...)
+	}
+	if err := cli.Formatter.Format(data, &viper.Viper{}, cli.CLIOutputOptions{cols, wideCols, totals, wideTotals, map[string]string{}}); err != nil {
+		logger.Fatalf("Formatting failed: %s", err.Error())
+	}
+}
+
+// Default time range of the meter commands, ending now.
+const meteringDefaultRange = time.Hour
+
+// parseDuration parses a duration that may also be given in days or weeks,
+// such as 7d or 2w.
+func parseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for unit, duration := range units {
+		if strings.HasSuffix(s, unit) {
+			if n, err := strconv.Atoi(strings.TrimSuffix(s, unit)); err == nil {
+				if n <= 0 || n > int(math.MaxInt64/duration) {
+					return 0, errors.Errorf("Invalid duration %q, expected a positive duration", s)
+				}
+				return time.Duration(n) * duration, nil
+			}
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.Errorf("Invalid duration %q, expected a positive duration", s)
+	}
+	return d, nil
+}
+
+// unixTimestamp matches unix timestamps, in seconds with an optional
+// fraction.
+var unixTimestamp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// maxUnixTimestamp is the last second of the year 9999, the latest time
+// that can be formatted as RFC3339.
+const maxUnixTimestamp = 253402300799
+
+// timePeriod returns the start and end of a calendar period in the local
+// time zone: a date such as 2022-07-01, a month such as 2022-07, or one of
+// today, yesterday, this-week, last-week, this-month, last-month,
+// this-year and last-year. Weeks start on Monday.
+func timePeriod(s string, now time.Time) (time.Time, time.Time, bool) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	week := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	year := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, now.Location())
+	switch s {
+	case "today":
+		return today, today.AddDate(0, 0, 1), true
+	case "yesterday":
+		return today.AddDate(0, 0, -1), today, true
+	case "this-week":
+		return week, week.AddDate(0, 0, 7), true
+	case "last-week":
+		return week.AddDate(0, 0, -7), week, true
+	case "this-month":
+		return month, month.AddDate(0, 1, 0), true
+	case "last-month":
+		return month.AddDate(0, -1, 0), month, true
+	case "this-year":
+		return year, year.AddDate(1, 0, 0), true
+	case "last-year":
+		return year.AddDate(-1, 0, 0), year, true
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, now.Location()); err == nil {
+		return t, t.AddDate(0, 0, 1), true
+	}
+	if t, err := time.ParseInLocation("2006-01", s, now.Location()); err == nil {
+		return t, t.AddDate(0, 1, 0), true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// parseTimeAt parses a time given as a unix timestamp, an RFC3339 time, a
+// time relative to now such as now, -7d or now-1h, or a calendar period.
+// Periods are parsed as their start, or their end if end is true.
+func parseTimeAt(s string, now time.Time, end bool) (time.Time, error) {
+	if unixTimestamp.MatchString(s) {
+		t, err := strconv.ParseFloat(s, 64)
+		if err != nil || t <= 0 || t > maxUnixTimestamp {
+			return time.Time{}, errors.Errorf("Invalid unix timestamp %q, expected a positive number of seconds up to %d", s, maxUnixTimestamp)
+		}
+		s, ns := math.Modf(t)
+		return time.Unix(int64(s), int64(ns*float64(time.Second))).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if periodStart, periodEnd, ok := timePeriod(s, now); ok {
+		if end {
+			return periodEnd, nil
+		}
+		return periodStart, nil
+	}
+	offset := strings.TrimPrefix(s, "now")
+	if offset == "" {
+		return now, nil
+	}
+	if strings.HasPrefix(offset, "-") || strings.HasPrefix(offset, "+") {
+		if d, err := parseDuration(offset[1:]); err == nil && d > 0 {
+			if offset[0] == '-' {
+				d = -d
+			}
+			return now.Add(d), nil
+		}
+	}
+	return time.Time{}, errors.Errorf("cannot parse %q to a valid timestamp, expected a unix timestamp, an RFC3339 time, a date, a time relative to now such as -7d or now-1h, or a period such as yesterday or last-month", s)
+}
+
+// parseTimeRange parses the --start and --end of the meter commands. When
+// start is a calendar period and end is not given, the range covers the
+// period up to now. Otherwise start defaults to an hour before end, and
+// end to now.
+func parseTimeRange(dtStart, dtEnd string) (time.Time, time.Time, error) {
+	now := time.Now()
+	end := now
+	if dtEnd != "" {
+		var err error
+		end, err = parseTimeAt(dtEnd, now, true)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.Errorf("Invalid end: %s", err)
+		}
+	} else if _, periodEnd, ok := timePeriod(dtStart, now); ok && periodEnd.Before(now) {
+		end = periodEnd
+	}
+	start := end.Add(-meteringDefaultRange)
+	if dtStart != "" {
+		var err error
+		start, err = parseTimeAt(dtStart, now, false)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.Errorf("Invalid start: %s", err)
+		}
+	}
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, errors.Errorf("Invalid time range: start %s is not before end %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+	return start, end, nil
+}
+
+// addDatapointsTimeParsing lets the --start, --end and --time of the
+// datapoints command be given in any format parseTimeAt accepts.
+func addDatapointsTimeParsing() {
+	cmd, _, err := cli.Root.Find([]string{"get", "datapoints"})
+	if err != nil || cmd.Name() != "datapoints" {
+		return
+	}
+	run := cmd.Run
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		now := time.Now()
+		times := make(map[string]time.Time)
+		for _, name := range []string{"start", "end", "time"} {
+			value, _ := cmd.Flags().GetString(name)
+			if value == "" {
+				continue
+			}
+			t, err := parseTimeAt(value, now, name == "end")
+			if err != nil {
+				logger.Fatalf("Invalid %s: %s", name, err)
+			}
+			times[name] = t
+			cmd.Flags().Set(name, strconv.FormatInt(t.Unix(), 10))
+		}
+		start, hasStart := times["start"]
+		end, hasEnd := times["end"]
+		if hasStart && hasEnd && !start.Before(end) {
+			logger.Fatalf("Invalid time range: start %s is not before end %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+		}
+		run(cmd, args)
+	}
+}
+
+// getResourceNamesIDMap returns the names of the resources of a type that
+// match search by id.
+func getResourceNamesIDMap(resource, search string) map[string]string {
+	resourceNames := make(map[string]string)
+	for id, row := range getResourceRows(resource, search) {
+		resourceNames[id] = rowName(row)
 	}
 	return resourceNames
 }
 
-func mapResourceNamesWithMetrics(response promqlResponse, search string) (map[string]string, map[string]map[string]string, map[string]string) {
+func mapResourceNamesWithMetrics(response promqlResponse, resource, search string) (map[string]string, map[string]map[string]string, map[string]string) {
+	metricsNameSet, resourceIDToMetricMap := resourceMetricsFromResponse(response, resource)
+	return metricsNameSet, resourceIDToMetricMap, getResourceNamesIDMap(resource, search)
+}
+
+// resourceMetricsFromResponse returns the types of the metrics of the series
+// of the resources of a type in response, and their values by resource id
+// and metric.
+func resourceMetricsFromResponse(response promqlResponse, resource string) (map[string]string, map[string]map[string]string) {
 	metricsNameSet := make(map[string]string)
 	resourceIDToMetricMap := make(map[string]map[string]string)
-	resourceIDToNameMap := getResourceNamesIDMap(search)
 
 	for _, item := range response.Data.DataPromql.Result {
-		resourceID, ok := item.Metric["machine_id"]
-		if !ok {
-			resourceID, ok = item.Metric["volume_id"]
-			if !ok {
-				continue
-			}
+		seriesType, resourceID, ok := seriesResource(item.Metric)
+		if !ok || seriesType != resource {
+			continue
 		}
 		if resourceIDToMetricMap[resourceID] == nil {
 			resourceIDToMetricMap[resourceID] = make(map[string]string)
 		}
 		if item.Value != nil {
-			resourceIDToMetricMap[resourceID][item.Metric["__name__"]] = item.Value[1].(string)
+			metric := item.Metric["__name__"]
+			value, _ := item.Value[1].(string)
+			// A resource may have several series of a metric, such as one
+			// per disk, which are summed.
+			if previous, ok := resourceIDToMetricMap[resourceID][metric]; ok {
+				previousFloat, err1 := strconv.ParseFloat(previous, 64)
+				valueFloat, err2 := strconv.ParseFloat(value, 64)
+				if err1 == nil && err2 == nil {
+					value = fmt.Sprintf("%f", previousFloat+valueFloat)
+				}
+			}
+			resourceIDToMetricMap[resourceID][metric] = value
 		}
 		metricsNameSet[item.Metric["__name__"]] = item.Metric["value_type"]
 	}
 
-	return metricsNameSet, resourceIDToMetricMap, resourceIDToNameMap
+	return metricsNameSet, resourceIDToMetricMap
 }
 
-func getMeteringData(dtStart, dtEnd, search, queryTemplate string) (map[string]string, map[string]map[string]string, map[string]string) {
+// queryDatapoints runs a PromQL query at time t.
+func queryDatapoints(query string, t time.Time, search string) (promqlResponse, error) {
+	var response promqlResponse
 	paramsGetDatapoints := viper.New()
-	paramsGetDatapoints.Set("time", dtEnd)
+	paramsGetDatapoints.Set("time", strconv.FormatInt(t.Unix(), 10))
 	paramsGetDatapoints.Set("search", search)
-	dtStartTime, _ := parseTime(dtStart)
-	dtEndTime, _ := parseTime(dtEnd)
-	timeRange := int((dtEndTime.Sub(dtStartTime)).Seconds())
-	query := fmt.Sprintf(queryTemplate, timeRange)
 	_, decoded, _, err := MistApiV2GetDatapoints(query, paramsGetDatapoints)
 	if err != nil {
-		logger.Fatalf("Error calling operation: %s", err.Error())
+		return response, errors.Wrap(err, "Error calling operation")
 	}
 
 	rawResponse, err := json.Marshal(decoded)
 	if err != nil {
-		fmt.Println("error:", err)
+		return response, errors.Wrap(err, "Error reading datapoints")
 	}
 
-	var response promqlResponse
 	err = json.Unmarshal(rawResponse, &response)
 	if err != nil {
-		fmt.Println("error:", err)
+		return response, errors.Wrap(err, "Error reading datapoints")
+	}
+	return response, nil
+}
+
+// Types of resources with metering data, from the most to the least
+// specific. The series of a resource may also have the <resource>_id labels
+// of the resources that contain it, such as the machine_id of the machine a
+// volume is attached to or the cluster_id of the cluster of a machine.
+var meteredResources = []string{"volume", "machine", "cluster"}
+
+// seriesResource returns the type and id of the resource a metering series
+// is about: the most specific of the meteredResources it has a
+// <resource>_id label for. Labels of other types are ignored.
+func seriesResource(metric map[string]string) (string, string, bool) {
+	for _, resource := range meteredResources {
+		if id := metric[resource+"_id"]; id != "" {
+			return resource, id, true
+		}
+	}
+	return "", "", false
+}
+
+// getMeteredResources returns the types of the resources with metering data
+// between dtStart and dtEnd, as found by seriesResource.
+func getMeteredResources(dtStart, dtEnd time.Time, search string) ([]string, error) {
+	query := fmt.Sprintf("last_over_time({metering=\"true\"}[%ds])", int(dtEnd.Sub(dtStart).Seconds()))
+	response, err := queryDatapoints(query, dtEnd, search)
+	if err != nil {
+		return nil, err
+	}
+	resourcesSet := make(map[string]bool)
+	for _, item := range response.Data.DataPromql.Result {
+		if resource, _, ok := seriesResource(item.Metric); ok {
+			resourcesSet[resource] = true
+		}
+	}
+	resources := make([]string, 0, len(resourcesSet))
+	for resource := range resourcesSet {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+	return resources, nil
+}
+
+func getMeteringData(dtStart, dtEnd time.Time, resource, search, queryTemplate string) (map[string]string, map[string]map[string]string, map[string]string, error) {
+	if !dtStart.Before(dtEnd) {
+		return nil, nil, nil, errors.Errorf("Invalid time range: start %s is not before end %s", dtStart.Format(time.RFC3339), dtEnd.Format(time.RFC3339))
+	}
+	timeRange := int((dtEnd.Sub(dtStart)).Seconds())
+	query := fmt.Sprintf(queryTemplate, timeRange)
+	response, err := queryDatapoints(query, dtEnd, search)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	return mapResourceNamesWithMetrics(response, search)
+	metricsSet, resourceMetrics, resourceNames := mapResourceNamesWithMetrics(response, resource, search)
+	return metricsSet, resourceMetrics, resourceNames, nil
 }
 
 func calculateDiffs(resourceMetricsStart map[string]map[string]string, resourceMetricsEnd map[string]map[string]string, metricsSet map[string]string) map[string]map[string]string {
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+// Metering datapoints at the start and end of a day, in the shape they are
+// returned by get datapoints. m2 was created during the day, the counter of
+// m4 was reset and m3 has no running time counter. The volume series has
+// the machine_id of the machine it is attached to.
+const (
+	meteringStartResponse = `{"data": {"data": {"resultType": "vector", "result": [
+		{"metric": {"__name__": "machine_running_seconds", "metering": "true", "value_type": "counter", "machine_id": "m1", "cloud_id": "c1"}, "value": [1656633600, "1000"]},
+		{"metric": {"__name__": "machine_running_seconds", "metering": "true", "value_type": "counter", "machine_id": "m4", "cloud_id": "c1"}, "value": [1656633600, "50000"]},
+		{"metric": {"__name__": "cores", "metering": "true", "value_type": "gauge", "machine_id": "m1", "cloud_id": "c1"}, "value": [1656633600, "2"]},
+		{"metric": {"__name__": "cores", "metering": "true", "value_type": "gauge", "machine_id": "m3", "cloud_id": "c1"}, "value": [1656633600, "4"]},
+		{"metric": {"__name__": "volume_size", "metering": "true", "value_type": "gauge", "volume_id": "v1", "machine_id": "m1"}, "value": [1656633600, "20"]}
+	]}}}`
+	meteringEndResponse = `{"data": {"data": {"resultType": "vector", "result": [
+		{"metric": {"__name__": "machine_running_seconds", "metering": "true", "value_type": "counter", "machine_id": "m1", "cloud_id": "c1"}, "value": [1656720000, "37000"]},
+		{"metric": {"__name__": "machine_running_seconds", "metering": "true", "value_type": "counter", "machine_id": "m2", "cloud_id": "c1"}, "value": [1656720000, "7200"]},
+		{"metric": {"__name__": "machine_running_seconds", "metering": "true", "value_type": "counter", "machine_id": "m4", "cloud_id": "c1"}, "value": [1656720000, "3600"]},
+		{"metric": {"__name__": "cores", "metering": "true", "value_type": "gauge", "machine_id": "m1", "cloud_id": "c1"}, "value": [1656720000, "2"]},
+		{"metric": {"__name__": "cores", "metering": "true", "value_type": "gauge", "machine_id": "m3", "cloud_id": "c1"}, "value": [1656720000, "4"]},
+		{"metric": {"__name__": "volume_size", "metering": "true", "value_type": "gauge", "volume_id": "v1", "machine_id": "m1"}, "value": [1656720000, "20"]}
+	]}}}`
+)
+
+func parseMeteringResponse(t *testing.T, s string) promqlResponse {
+	var response promqlResponse
+	if err := json.Unmarshal([]byte(s), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestGetCostRows(t *testing.T) {
+	_, start := resourceMetricsFromResponse(parseMeteringResponse(t, meteringStartResponse), "machine")
+	metricsSet, end := resourceMetricsFromResponse(parseMeteringResponse(t, meteringEndResponse), "machine")
+	if _, ok := metricsSet["volume_size"]; ok {
+		t.Fatal("volume series counted for its machine")
+	}
+	if err := checkUsageMetric("cores", metricsSet); err == nil {
+		t.Fatal("gauge accepted as usage metric")
+	}
+	if err := checkUsageMetric("machine_running_seconds", metricsSet); err != nil {
+		t.Fatal(err)
+	}
+	diffs := calculateDiffs(start, end, metricsSet)
+	costs := map[string]resourceCost{
+		"m1": {name: "web-1", hourly: 0.5},
+		"m2": {name: "web-2", hourly: 0.1, monthly: 73},
+		"m3": {name: "web-3", hourly: 1},
+		"m4": {name: "web-4", hourly: 1},
+	}
+	for _, test := range []struct {
+		usageMetric string
+		hours       []float64
+		basis       []string
+	}{
+		{"machine_running_seconds", []float64{10, 2, 24, 24}, []string{"machine_running_seconds", "machine_running_seconds", "range", "range"}},
+		{"", []float64{24, 24, 24, 24}, []string{"range", "range", "range", "range"}},
+	} {
+		rows := getCostRows(diffs, costs, test.usageMetric, 24)
+		if len(rows) != 4 {
+			t.Fatalf("%d rows, want 4", len(rows))
+		}
+		for i, row := range rows {
+			if row.hours != test.hours[i] || row.basis != test.basis[i] {
+				t.Errorf("%s: %v hours of %s, want %v of %s", row.cost.name, row.hours, row.basis, test.hours[i], test.basis[i])
+			}
+			if want := row.cost.hourly * test.hours[i]; math.Abs(row.spend-want) > 1e-9 {
+				t.Errorf("%s: spend %v, want %v", row.cost.name, row.spend, want)
+			}
+		}
+	}
+}
+
+func TestStepValue(t *testing.T) {
+	// A counter with a gap at step 2.
+	series := map[int]float64{0: 100, 1: 160, 3: 400, 4: 430}
+	for _, test := range []struct {
+		step    int
+		counter bool
+		value   float64
+		ok      bool
+	}{
+		{1, true, 60, true},
+		{2, true, 0, false},
+		{3, true, 0, false},
+		{4, true, 30, true},
+		{3, false, 400, true},
+		{2, false, 0, false},
+	} {
+		value, ok := stepValue(series, test.step, test.counter)
+		if value != test.value || ok != test.ok {
+			t.Errorf("step %d, counter %v: got %v, %v, want %v, %v", test.step, test.counter, value, ok, test.value, test.ok)
+		}
+	}
+}
+
+func TestParseTimeAtRejectsInvalidNumbers(t *testing.T) {
+	now := time.Date(2022, time.July, 15, 12, 0, 0, 0, time.UTC)
+	for _, s := range []string{"inf", "+Inf", "NaN", "1e9", "-5", "0", "99999999999999999999", "now-0d", "-99999999999w", "now-1e3h"} {
+		if t0, err := parseTimeAt(s, now, false); err == nil {
+			t.Errorf("%q parsed as %s", s, t0)
+		}
+	}
+	for s, want := range map[string]time.Time{
+		"1656633600":           time.Unix(1656633600, 0).UTC(),
+		"1656633600.5":         time.Unix(1656633600, int64(time.Second/2)).UTC(),
+		"-7d":                  now.AddDate(0, 0, -7),
+		"now-1h":               now.Add(-time.Hour),
+		"2022-07-01":           time.Date(2022, time.July, 1, 0, 0, 0, 0, time.UTC),
+		"2022-07-01T00:00:00Z": time.Date(2022, time.July, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		got, err := parseTimeAt(s, now, false)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("%q parsed as %s, %v, want %s", s, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+)
+
+// remoteTunnel is a byte stream to a TCP port reachable from a machine. It
+// is relayed by a process that replaces the shell opened by the ssh
+// action, with the remote terminal in raw mode so that binary data passes
+// through unmodified.
+type remoteTunnel struct {
+	c          *websocket.Conn
+	writeMutex sync.Mutex
+	writeWait  time.Duration
+	pending    []byte
+	r          io.Reader
+	cancel     context.CancelFunc
+}
+
+// relayCommand returns a command that connects its stdin and stdout to
+// host:port, using nc if available or bash otherwise.
+func relayCommand(host string, port int) string {
+	return fmt.Sprintf("if command -v nc >/dev/null 2>&1; then exec nc %s %d; else exec bash -c %s; fi",
+		shellQuote(host), port, shellQuote(fmt.Sprintf("exec 3<>/dev/tcp/%s/%d; cat <&3 & exec cat >&3", host, port)))
+}
+
+func dialRemoteTunnel(machine, host string, port int) (*remoteTunnel, error) {
+	c, err := dialMachineShell(machine)
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := newRemoteCommand(relayCommand(host, port))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &remoteTunnel{c: c, writeWait: sessionWriteWait, cancel: cancel}
+	c.SetReadDeadline(time.Now().Add(sessionPongWait))
+	c.SetPongHandler(func(string) error { c.SetReadDeadline(time.Now().Add(sessionPongWait)); return nil })
+	go sendPingMessages(ctx, c, make(chan error, 1), sessionWriteWait, sessionPingPeriod)
+	script := "stty raw -echo -iexten 2>/dev/null; printf '%s%s\\n' " + splitMarker(cmd.beginMarker) + "; " + cmd.command + "\n"
+	if err := writeRemoteStdin(c, []byte(script), &t.writeMutex, sessionWriteWait); err != nil {
+		t.Close()
+		return nil, err
+	}
+	// Discard everything the shell prints until the relay has started.
+	_, t.pending, err = readUntilMarker(c, cmd.beginMarker)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("Could not start tunnel: %v", err)
+	}
+	return t, nil
+}
+
+func (t *remoteTunnel) Read(p []byte) (int, error) {
+	for {
+		if len(t.pending) > 0 {
+			n := copy(p, t.pending)
+			t.pending = t.pending[n:]
+			return n, nil
+		}
+		if t.r != nil {
+			n, err := t.r.Read(p)
+			if err == io.EOF {
+				t.r = nil
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+			return n, err
+		}
+		mt, r, err := t.c.NextReader()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if mt == websocket.BinaryMessage {
+			t.r = r
+		}
+	}
+}
+
+func (t *remoteTunnel) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		end := written + remoteInputChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := writeRemoteStdin(t.c, p[written:end], &t.writeMutex, t.writeWait); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return len(p), nil
+}
+
+func (t *remoteTunnel) Close() error {
+	t.cancel()
+	return t.c.Close()
+}
+
+// parsePortMapping parses a LOCAL:[HOST:]REMOTE port mapping.
+func parsePortMapping(mapping string) (int, string, int, error) {
+	parts := strings.Split(mapping, ":")
+	host := "127.0.0.1"
+	switch len(parts) {
+	case 2:
+	case 3:
+		host = parts[1]
+		parts = []string{parts[0], parts[2]}
+	default:
+		return 0, "", 0, fmt.Errorf("Invalid port mapping %q, expected LOCAL:[HOST:]REMOTE", mapping)
+	}
+	localPort, err := strconv.Atoi(parts[0])
+	if err != nil || localPort < 0 || localPort > 65535 {
+		return 0, "", 0, fmt.Errorf("Invalid local port %q", parts[0])
+	}
+	remotePort, err := strconv.Atoi(parts[1])
+	if err != nil || remotePort < 1 || remotePort > 65535 {
+		return 0, "", 0, fmt.Errorf("Invalid remote port %q", parts[1])
+	}
+	return localPort, host, remotePort, nil
+}
+
+// forwardConnection relays a local connection through a new tunnel until
+// both directions are done. When the remote end closes, the write side of
+// the local connection is closed, so that a client that half-closed after
+// sending a request still receives the whole response. The remote terminal
+// is in raw mode and can not deliver an end of file, so when the client
+// closes its write side the tunnel is kept open until the remote end
+// closes.
+func forwardConnection(conn net.Conn, machine, host string, port int) {
+	defer conn.Close()
+	t, err := dialRemoteTunnel(machine, host, port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not forward connection from %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	defer t.Close()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(t, conn); err != nil {
+			// The local connection failed, so the response can not be
+			// delivered anymore.
+			t.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, t)
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	}()
+	wg.Wait()
+}
+
+func portForwardCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "port-forward MACHINE LOCAL:[HOST:]REMOTE",
+		Short: "Forward a local port to a port on a machine",
+		Long: `Listen on a local port and forward each connection to a port on a machine,
+  or to a host reachable from it, through the machine's ssh connection.`,
+		Example: `  mist port-forward machine-name 5432:5432
+  mist port-forward machine-name 8080:10.0.0.5:80`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			machine := args[0]
+			localPort, host, remotePort, err := parsePortMapping(args[1])
+			if err != nil {
+				logger.Fatal(err)
+			}
+			listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+			if err != nil {
+				logger.Fatal(err)
+			}
+			fmt.Fprintf(os.Stderr, "Forwarding from %s -> %s:%d\n", listener.Addr(), host, remotePort)
+
+			var connsMutex sync.Mutex
+			conns := make(map[net.Conn]bool)
+			var wg sync.WaitGroup
+			sigc := make(chan os.Signal, 1)
+			signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-sigc
+				listener.Close()
+				connsMutex.Lock()
+				for conn := range conns {
+					conn.Close()
+				}
+				connsMutex.Unlock()
+			}()
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					if !errors.Is(err, net.ErrClosed) {
+						fmt.Fprintln(os.Stderr, err)
+					}
+					break
+				}
+				connsMutex.Lock()
+				conns[conn] = true
+				connsMutex.Unlock()
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					forwardConnection(conn, machine, host, remotePort)
+					connsMutex.Lock()
+					delete(conns, conn)
+					connsMutex.Unlock()
+				}()
+			}
+			wg.Wait()
+		},
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
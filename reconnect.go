@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Maximum number of attempts to reconnect after the connection is lost.
+	reconnectMaxAttempts = 10
+
+	// Maximum time to wait between two attempts to reconnect.
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// Whether the shell of a session opened with --reconnect survives the loss
+// of the connection.
+type persistentShellState int
+
+const (
+	// tmux is not available, so a plain shell was opened.
+	persistentShellUnavailable persistentShellState = iota
+	// A new tmux session was created.
+	persistentShellCreated
+	// An existing tmux session was attached.
+	persistentShellAttached
+)
+
+// printSessionStatus prints a message about the state of the connection on
+// stderr, while the local terminal is in raw mode.
+func printSessionStatus(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "\r\n[mist] "+format+"\r\n", a...)
+}
+
+// startPersistentShell runs the shell of the session inside the tmux
+// session with the given name, creating it if needed, so that it can be
+// attached again after reconnecting.
+func startPersistentShell(c *websocket.Conn, session string, writeWait, pongWait time.Duration) (persistentShellState, error) {
+	var writeMutex sync.Mutex
+	if err := updateTerminalSize(c, &writeMutex, writeWait); err != nil {
+		return persistentShellUnavailable, err
+	}
+	unavailable, err := newMarker("PLAIN")
+	if err != nil {
+		return persistentShellUnavailable, err
+	}
+	created, err := newMarker("CREATED")
+	if err != nil {
+		return persistentShellUnavailable, err
+	}
+	attached, err := newMarker("ATTACHED")
+	if err != nil {
+		return persistentShellUnavailable, err
+	}
+	script := "stty -echo 2>/dev/null; if command -v tmux >/dev/null 2>&1; then " +
+		"if tmux has-session -t " + shellQuote(session) + " 2>/dev/null; then printf '%s%s\\n' " + splitMarker(attached) + "; " +
+		"else printf '%s%s\\n' " + splitMarker(created) + "; fi; " +
+		"stty echo 2>/dev/null; exec tmux new-session -A -s " + shellQuote(session) + "; fi; " +
+		"stty echo 2>/dev/null; printf '%s%s\\n' " + splitMarker(unavailable) + "\n"
+	if err := writeRemoteStdin(c, []byte(script), &writeMutex, writeWait); err != nil {
+		return persistentShellUnavailable, err
+	}
+	c.SetReadDeadline(time.Now().Add(pongWait))
+	c.SetPongHandler(func(string) error { c.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	state, rest, err := readUntilMarker(c, unavailable, created, attached)
+	if err != nil {
+		return persistentShellUnavailable, err
+	}
+	sessionStdout().Write(rest)
+	return persistentShellState(state), nil
+}
+
+// redialMachineShell opens a new connection to the shell of a machine,
+// retrying with exponential backoff.
+func redialMachineShell(machine string) (*websocket.Conn, error) {
+	backoff := time.Second
+	var err error
+	for attempt := 1; attempt <= reconnectMaxAttempts; attempt++ {
+		time.Sleep(backoff)
+		var c *websocket.Conn
+		c, err = dialMachineShell(machine)
+		if err == nil {
+			return c, nil
+		}
+		if errors.Is(err, errAuthRejected) || errors.Is(err, errMachineNotFound) {
+			return nil, err
+		}
+		printSessionStatus("Reconnect attempt %d/%d failed: %s", attempt, reconnectMaxAttempts, err)
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+	return nil, err
+}
+
+// runReconnectingShellSession relays the local terminal to the shell of a
+// machine like runShellSession, reconnecting whenever the connection is
+// lost.
+func runReconnectingShellSession(ctx context.Context, machine string, c *websocket.Conn, input <-chan []byte, writeWait, pongWait, pingPeriod time.Duration) error {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		c.Close()
+		return err
+	}
+	session := "mist-" + hex.EncodeToString(id)
+	reconnected := false
+	for {
+		state, err := startPersistentShell(c, session, writeWait, pongWait)
+		if err == nil {
+			switch {
+			case !reconnected && state == persistentShellUnavailable:
+				printSessionStatus("tmux is not available on %s, the remote shell will not be preserved if the connection is lost", machine)
+			case reconnected && state == persistentShellAttached:
+				printSessionStatus("Reconnected, the remote shell was preserved")
+			case reconnected && state == persistentShellCreated:
+				printSessionStatus("Reconnected, the previous remote shell was lost and a new one was opened")
+			case reconnected:
+				printSessionStatus("Reconnected, a new remote shell was opened")
+			}
+			err = runShellSession(ctx, c, input, writeWait, pongWait, pingPeriod)
+			if !errors.Is(err, errConnectionLost) {
+				c.Close()
+				return err
+			}
+		}
+		c.Close()
+		printSessionStatus("Connection lost, reconnecting...")
+		c, err = redialMachineShell(machine)
+		if errors.Is(err, errAuthRejected) || errors.Is(err, errMachineNotFound) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("%w, could not reconnect: %s", errConnectionLost, err)
+		}
+		reconnected = true
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	terminal "golang.org/x/term"
+)
+
+// sessionRecorder records the ssh session, if --record was given.
+var sessionRecorder *asciicastRecorder
+
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// asciicastRecorder writes the output, input and resize events of a
+// terminal session to a file in asciicast v2 format.
+type asciicastRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	start   time.Time
+	pending map[string][]byte
+}
+
+func newAsciicastRecorder(path, title string) (*asciicastRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	start := time.Now()
+	header, err := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Write(append(header, '\n')); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &asciicastRecorder{f: f, start: start, pending: make(map[string][]byte)}, nil
+}
+
+// splitIncompleteUTF8 splits off a UTF-8 sequence that was cut short at
+// the end of b, so that it can be recorded along with the rest of it.
+func splitIncompleteUTF8(b []byte) ([]byte, []byte) {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i], b[i:]
+			}
+			break
+		}
+	}
+	return b, nil
+}
+
+func (r *asciicastRecorder) event(code string, data []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, r.pending[code] = splitIncompleteUTF8(append(r.pending[code], data...))
+	if len(data) == 0 {
+		return
+	}
+	event, err := json.Marshal([]interface{}{time.Since(r.start).Seconds(), code, string(data)})
+	if err != nil {
+		return
+	}
+	r.f.Write(append(event, '\n'))
+}
+
+func (r *asciicastRecorder) Write(p []byte) (int, error) {
+	r.event("o", p)
+	return len(p), nil
+}
+
+func (r *asciicastRecorder) input(p []byte) {
+	r.event("i", p)
+}
+
+func (r *asciicastRecorder) resize(width, height int) {
+	r.event("r", []byte(fmt.Sprintf("%dx%d", width, height)))
+}
+
+func (r *asciicastRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// sessionStdout returns the writer that the output of the ssh session is
+// copied to.
+func sessionStdout() io.Writer {
+	if sessionRecorder == nil {
+		return os.Stdout
+	}
+	return io.MultiWriter(os.Stdout, sessionRecorder)
+}
+
+// replayAsciicast plays back the output events of an asciicast v2 file.
+// Delays between events are divided by speed and, if idleLimit is not
+// zero, capped to it.
+func replayAsciicast(path string, speed float64, idleLimit time.Duration) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		return fmt.Errorf("%s is empty", path)
+	}
+	var header asciicastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 {
+		return fmt.Errorf("%s is not an asciicast v2 file", path)
+	}
+	previous := 0.0
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			return fmt.Errorf("Invalid event in %s: %s", path, scanner.Text())
+		}
+		at, ok := event[0].(float64)
+		code, _ := event[1].(string)
+		data, _ := event[2].(string)
+		if !ok || code != "o" {
+			continue
+		}
+		delay := time.Duration((at - previous) / speed * float64(time.Second))
+		if idleLimit > 0 && delay > idleLimit {
+			delay = idleLimit
+		}
+		time.Sleep(delay)
+		previous = at
+		os.Stdout.WriteString(data)
+	}
+	return scanner.Err()
+}
+
+func sshReplayCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "replay FILE",
+		Short: "Play back a session recorded with --record",
+		Example: `  mist ssh replay session.cast
+  mist ssh replay session.cast --speed 4 --idle-limit 2`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			speed := params.GetFloat64("speed")
+			if speed <= 0 {
+				logger.Fatal("--speed must be greater than 0")
+			}
+			idleLimit := time.Duration(params.GetFloat64("idle-limit") * float64(time.Second))
+			if err := replayAsciicast(args[0], speed, idleLimit); err != nil {
+				logger.Fatal(err)
+			}
+		},
+	}
+	cmd.Flags().Float64("speed", 1, "Playback speed multiplier")
+	cmd.Flags().Float64("idle-limit", 0, "Limit pauses between output to this many seconds")
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// bridgeStdio relays stdin and stdout to the ssh server of a machine, for
+// use as an OpenSSH ProxyCommand.
+func bridgeStdio(machine string) error {
+	t, err := dialRemoteTunnel(machine, "127.0.0.1", 22)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(t, os.Stdin)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(os.Stdout, t)
+		done <- err
+	}()
+	return <-done
+}
+
+// sshConfigHost returns a Host alias for a machine name, which may not
+// contain whitespace.
+func sshConfigHost(name string) string {
+	return strings.Join(strings.Fields(name), "-")
+}
+
+func sshConfigCmd() *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:   "ssh-config",
+		Short: "Print an OpenSSH config for machines",
+		Long: `Print Host blocks for machines that connect through Mist with
+  "mist ssh --stdio", so that ssh, scp, rsync and other OpenSSH clients can
+  be used with them. Add the output to ~/.ssh/config, or save it to a file
+  and include it with an Include line at the top of ~/.ssh/config.`,
+		Example: `  mist ssh-config --search "state:running" > ~/.ssh/mist_config
+  ssh machine-name`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := setContext()
+			if err != nil {
+				logger.Fatalf("Could not set context %s", err)
+			}
+			machines, err := listMachines(params.GetString("search"))
+			if err != nil {
+				logger.Fatalf("Error calling operation: %s", err.Error())
+			}
+			mistCLIPath, err := os.Executable()
+			if err != nil {
+				logger.Fatal(err)
+			}
+			if strings.ContainsAny(mistCLIPath, " \t'\"\\$`") {
+				mistCLIPath = shellQuote(mistCLIPath)
+			}
+			seen := make(map[string]bool)
+			fmt.Printf("# Generated by mist ssh-config for context %s\n", viper.GetString("context"))
+			for _, machine := range machines {
+				host := params.GetString("prefix") + sshConfigHost(machine.name)
+				if seen[host] {
+					host = params.GetString("prefix") + machine.id
+				}
+				seen[host] = true
+				fmt.Printf("\nHost %s\n", host)
+				fmt.Printf("  HostName %s\n", machine.id)
+				if user := params.GetString("user"); user != "" {
+					fmt.Printf("  User %s\n", user)
+				}
+				fmt.Printf("  ProxyCommand %s ssh --stdio %%h --context=%s\n", mistCLIPath, viper.GetString("context"))
+			}
+		},
+	}
+	cmd.Flags().String("search", "", "Only include machines matching this search filter")
+	cmd.Flags().String("prefix", "", "Prefix of the Host alias of each machine")
+	cmd.Flags().String("user", "", "User to log in as on each machine")
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -35,20 +36,25 @@ func updateTerminalSize(c *websocket.Conn, writeMutex *sync.Mutex, writeWait tim
 	err = c.WriteMessage(websocket.BinaryMessage, append([]byte{1}, resizeMessageBinary...))
 	writeMutex.Unlock()
 	if err != nil {
-		return fmt.Errorf("write: %s", err)
+		return fmt.Errorf("%w: %s", errConnectionLost, err)
 	}
+	sessionRecorder.resize(width, height)
 	return nil
 }
 
-func handleTerminalResize(c *websocket.Conn, done *chan bool, writeMutex *sync.Mutex, writeWait time.Duration) {
-	defer func() { *done <- true }()
+func handleTerminalResize(ctx context.Context, c *websocket.Conn, errc chan<- error, writeMutex *sync.Mutex, writeWait time.Duration) {
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGWINCH)
+	defer signal.Stop(sigc)
 	for {
-		<-sigc
-		err := updateTerminalSize(c, writeMutex, writeWait)
-		if err != nil {
-			fmt.Println(err)
+		select {
+		case <-sigc:
+			err := updateTerminalSize(c, writeMutex, writeWait)
+			if err != nil {
+				errc <- err
+				return
+			}
+		case <-ctx.Done():
 			return
 		}
 	}
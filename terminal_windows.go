@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -40,26 +41,31 @@ func updateTerminalSize(c *websocket.Conn, writeMutex *sync.Mutex, writeWait tim
 	err = c.WriteMessage(websocket.BinaryMessage, append([]byte{1}, resizeMessageBinary...))
 	writeMutex.Unlock()
 	if err != nil {
-		return fmt.Errorf("write: %s", err)
+		return fmt.Errorf("%w: %s", errConnectionLost, err)
 	}
+	sessionRecorder.resize(resizeMessage.Width, resizeMessage.Height)
 	return nil
 }
 
-func handleTerminalResize(c *websocket.Conn, done *chan bool, writeMutex *sync.Mutex, writeWait time.Duration) {
-	defer func() { *done <- true }()
+func handleTerminalResize(ctx context.Context, c *websocket.Conn, errc chan<- error, writeMutex *sync.Mutex, writeWait time.Duration) {
 	oldTerminalSize := terminalSize{}
 	ticker := time.NewTicker(1000 * time.Millisecond)
+	defer ticker.Stop()
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
 		newTerminalSize, err := getTerminalSize()
 		if err != nil {
-			fmt.Println(err)
+			errc <- err
 			return
 		}
 		if newTerminalSize != oldTerminalSize {
 			err := updateTerminalSize(c, writeMutex, writeWait)
 			if err != nil {
-				fmt.Println(err)
+				errc <- err
 				return
 			}
 		}
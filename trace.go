@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// Levels of --verbose.
+const (
+	// Log the method, URL, status and latency of each request.
+	verboseRequests = 1
+	// Also log the headers and bodies of requests and responses.
+	verboseBodies = 2
+)
+
+// Headers whose values are not logged.
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// tracer logs to stderr, so that the output of commands is not mixed with
+// it.
+var tracer = log.New(os.Stderr, "", 0)
+
+// verbosityValue is the level of --verbose, raised by one each time the flag
+// is given. It also accepts true and false, as the bool --verbose of the cli
+// library does.
+type verbosityValue int
+
+func (v *verbosityValue) Set(s string) error {
+	if s == "+1" {
+		*v++
+		return nil
+	}
+	if level, err := strconv.Atoi(s); err == nil {
+		*v = verbosityValue(level)
+		return nil
+	}
+	enabled, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("Invalid verbosity %q", s)
+	}
+	*v = 0
+	if enabled {
+		*v = verboseRequests
+	}
+	return nil
+}
+
+func (v *verbosityValue) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+func (v *verbosityValue) Type() string {
+	return "count"
+}
+
+var verbosityLevel verbosityValue
+
+// addVerboseFlag adds -v/--verbose to the root command. If the cli library
+// already defines --verbose, without a shorthand, that flag is made to
+// count too and -v is added as a hidden flag that raises the same level. It
+// returns an error, without adding anything, if another command defines -v.
+func addVerboseFlag() error {
+	const usage = "Log the API requests to stderr, -vv also logs their headers and bodies"
+	var check func(cmd *cobra.Command) error
+	check = func(cmd *cobra.Command) error {
+		if flag := cmd.LocalFlags().ShorthandLookup("v"); flag != nil {
+			return fmt.Errorf("%s already defines -v as --%s", cmd.CommandPath(), flag.Name)
+		}
+		for _, child := range cmd.Commands() {
+			if err := check(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := check(cli.Root); err != nil {
+		return err
+	}
+	flags := cli.Root.PersistentFlags()
+	verbose := flags.Lookup("verbose")
+	if verbose == nil {
+		flags.VarPF(&verbosityLevel, "verbose", "v", usage).NoOptDefVal = "+1"
+		return nil
+	}
+	if valueType := verbose.Value.Type(); valueType != "bool" && valueType != "count" {
+		return fmt.Errorf("--verbose is already defined as a %s flag", valueType)
+	}
+	verbose.Value = &verbosityLevel
+	verbose.NoOptDefVal = "+1"
+	verbose.Usage = usage
+	if flags.Lookup("verbosity") != nil {
+		return fmt.Errorf("--verbosity is already defined")
+	}
+	alias := flags.VarPF(&verbosityLevel, "verbosity", "v", usage)
+	alias.NoOptDefVal = "+1"
+	alias.Hidden = true
+	return nil
+}
+
+// verbosity returns the level of --verbose.
+func verbosity() int {
+	return int(verbosityLevel)
+}
+
+// traceHeaders logs the headers of a request or response, with the values
+// of redactedHeaders replaced.
+func traceHeaders(prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header.Values(name) {
+			for _, redacted := range redactedHeaders {
+				if strings.EqualFold(name, redacted) {
+					value = "REDACTED"
+				}
+			}
+			tracer.Printf("%s %s: %s", prefix, name, value)
+		}
+	}
+}
+
+// traceBody logs body and returns a reader that reads it again.
+func traceBody(prefix string, body io.ReadCloser) (io.ReadCloser, error) {
+	if body == nil || body == http.NoBody {
+		return body, nil
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			tracer.Printf("%s %s", prefix, line)
+		}
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// traceRequest logs a request that is about to be sent. The body of req is
+// replaced, if it was logged.
+func traceRequest(req *http.Request) error {
+	level := verbosity()
+	if level < verboseRequests {
+		return nil
+	}
+	tracer.Printf("> %s %s", req.Method, req.URL)
+	if level < verboseBodies {
+		return nil
+	}
+	traceHeaders(">", req.Header)
+	body, err := traceBody(">", req.Body)
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+// traceResponse logs the response to a request sent at start, or the error
+// it failed with. The body of resp is replaced, if it was logged.
+func traceResponse(req *http.Request, resp *http.Response, err error, start time.Time) error {
+	level := verbosity()
+	if level < verboseRequests {
+		return nil
+	}
+	latency := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		tracer.Printf("< %s %s failed after %s: %s", req.Method, req.URL, latency, err)
+		return nil
+	}
+	if resp == nil {
+		return nil
+	}
+	tracer.Printf("< %s %s (%s)", resp.Proto, resp.Status, latency)
+	if level < verboseBodies {
+		return nil
+	}
+	traceHeaders("<", resp.Header)
+	// The body of a websocket handshake is the connection itself.
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+	body, err := traceBody("<", resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = body
+	return nil
+}
+
+// tracingTransport logs the requests it sends, as set by --verbose.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if verbosity() < verboseRequests {
+		return t.base.RoundTrip(req)
+	}
+	if err := traceRequest(req); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if traceErr := traceResponse(req, resp, err, start); traceErr != nil {
+		return nil, traceErr
+	}
+	return resp, err
+}
+
+// dialWebsocket opens a websocket with the default dialer, logging the
+// handshake as set by --verbose.
+func dialWebsocket(url string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	if verbosity() < verboseRequests {
+		return websocket.DefaultDialer.Dial(url, header)
+	}
+	tracer.Printf("> GET %s (websocket)", url)
+	if verbosity() >= verboseBodies {
+		traceHeaders(">", header)
+	}
+	start := time.Now()
+	c, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if resp == nil && err != nil {
+		tracer.Printf("< GET %s failed after %s: %s", url, time.Since(start).Round(time.Millisecond), err)
+		return c, resp, err
+	}
+	req := &http.Request{Method: http.MethodGet}
+	if traceErr := traceResponse(req, resp, nil, start); traceErr != nil {
+		return nil, nil, fmt.Errorf("Could not read the response of %s: %s", url, traceErr)
+	}
+	return c, resp, err
+}
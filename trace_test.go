@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+)
+
+// newTraceRoot replaces the root command with one that has a get command,
+// and the bool --verbose of the cli library if libraryVerbose is true.
+func newTraceRoot(t *testing.T, libraryVerbose bool) {
+	root := cli.Root
+	t.Cleanup(func() {
+		cli.Root = root
+		verbosityLevel = 0
+	})
+	cli.Root = &cobra.Command{Use: "mist"}
+	if libraryVerbose {
+		cli.Root.PersistentFlags().Bool("verbose", false, "Enable verbose log output")
+	}
+	cli.Root.AddCommand(&cobra.Command{Use: "get", Run: func(*cobra.Command, []string) {}})
+	verbosityLevel = 0
+}
+
+func TestAddVerboseFlag(t *testing.T) {
+	for _, libraryVerbose := range []bool{false, true} {
+		for _, test := range []struct {
+			args  []string
+			level int
+		}{
+			{[]string{"get"}, 0},
+			{[]string{"get", "-v"}, verboseRequests},
+			{[]string{"get", "-vv"}, verboseBodies},
+			{[]string{"-v", "get", "--verbose"}, verboseBodies},
+			{[]string{"get", "--verbose"}, verboseRequests},
+			{[]string{"get", "--verbose=true"}, verboseRequests},
+			{[]string{"get", "--verbose=2"}, verboseBodies},
+		} {
+			newTraceRoot(t, libraryVerbose)
+			if err := addVerboseFlag(); err != nil {
+				t.Fatal(err)
+			}
+			cli.Root.SetArgs(test.args)
+			if err := cli.Root.Execute(); err != nil {
+				t.Fatal(err)
+			}
+			if verbosity() != test.level {
+				t.Errorf("library --verbose %v, %v: level %d, want %d", libraryVerbose, test.args, verbosity(), test.level)
+			}
+		}
+	}
+}
+
+func TestAddVerboseFlagConflict(t *testing.T) {
+	newTraceRoot(t, true)
+	get, _, _ := cli.Root.Find([]string{"get"})
+	get.Flags().BoolP("version", "v", false, "")
+	if err := addVerboseFlag(); err == nil {
+		t.Fatal("-v added twice")
+	}
+	if cli.Root.PersistentFlags().Lookup("verbosity") != nil {
+		t.Fatal("flag added despite the conflict")
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.ops.mist.io/mistio/openapi-cli-generator/cli"
+	"gopkg.in/h2non/gentleman.v2"
+)
+
+const (
+	// Default time to wait between the first polls of a waiter.
+	waiterDefaultInterval = 2 * time.Second
+
+	// Maximum time to wait between two polls of a waiter, unless a longer
+	// --interval was given.
+	waiterMaxInterval = 30 * time.Second
+)
+
+// Exit codes of the wait commands.
+const (
+	waitExitError   = 1
+	waitExitTimeout = 2
+)
+
+var errWaitTimeout = errors.New("Timed out")
+
+// retryableStatusCodes are the status codes of responses to the polls of a
+// waiter that are retried instead of failing the wait.
+var retryableStatusCodes = []int{429, 502, 503, 504}
+
+// waiterBackoff spaces out the polls of a waiter with exponential backoff
+// and jitter, until --timeout expires.
+type waiterBackoff struct {
+	start       time.Time
+	interval    time.Duration
+	maxInterval time.Duration
+	timeout     time.Duration
+	rand        *rand.Rand
+}
+
+func newWaiterBackoff(params *viper.Viper) *waiterBackoff {
+	interval := params.GetDuration("interval")
+	if interval <= 0 {
+		interval = waiterDefaultInterval
+	}
+	maxInterval := waiterMaxInterval
+	if interval > maxInterval {
+		maxInterval = interval
+	}
+	return &waiterBackoff{
+		start:       time.Now(),
+		interval:    interval,
+		maxInterval: maxInterval,
+		timeout:     params.GetDuration("timeout"),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (b *waiterBackoff) elapsed() time.Duration {
+	return time.Since(b.start).Round(time.Second)
+}
+
+// sleep waits until the next poll. It returns an error if the timeout has
+// expired.
+func (b *waiterBackoff) sleep() error {
+	// Jitter keeps waiters started together from polling in lockstep.
+	delay := b.interval/2 + time.Duration(b.rand.Int63n(int64(b.interval/2)+1))
+	if b.timeout > 0 {
+		remaining := b.timeout - time.Since(b.start)
+		if remaining <= 0 {
+			return fmt.Errorf("%w after %s", errWaitTimeout, b.elapsed())
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+	}
+	time.Sleep(delay)
+	b.interval *= 2
+	if b.interval > b.maxInterval {
+		b.interval = b.maxInterval
+	}
+	return nil
+}
+
+// isRetryable returns whether a failed poll of a waiter should be retried:
+// if the request failed to connect or its status code is retryable or one
+// of codes.
+func isRetryable(resp *gentleman.Response, err error, codes ...int) bool {
+	if err != nil && (resp == nil || resp.StatusCode == 0) {
+		return true
+	}
+	if resp == nil {
+		return false
+	}
+	for _, code := range append(codes, retryableStatusCodes...) {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// addWaiterFlags adds the flags that configure a waiter to cmd.
+func addWaiterFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("timeout", 0, "Maximum time to wait, such as 90s or 2h (default no limit)")
+	cmd.Flags().Duration("interval", waiterDefaultInterval, "Initial time between checks, doubled after each check up to 30s")
+}
+
+// exitWaiter prints the error a wait failed with and exits with the exit
+// code for it.
+func exitWaiter(err error) {
+	logger.Printf("Error waiting: %s", err.Error())
+	if errors.Is(err, errWaitTimeout) {
+		os.Exit(waitExitTimeout)
+	}
+	os.Exit(waitExitError)
+}
+
+// jobFinishedWaiter waits until a job finishes, printing the actions in its
+// log as they happen, and returns an error if the job failed.
+func jobFinishedWaiter(jobID string, params *viper.Viper) error {
+	backoff := newWaiterBackoff(params)
+	reported := 0
+	for {
+		resp, decoded, _, err := MistApiV2GetJob(jobID, viper.New())
+		if err != nil && !isRetryable(resp, err, 404) {
+			return fmt.Errorf("Could not call waiter operation: %s", err)
+		}
+		if err == nil {
+			job, _ := decoded["data"].(map[string]interface{})
+			logs, _ := job["logs"].([]interface{})
+			if reported > len(logs) {
+				reported = 0
+			}
+			for _, item := range logs[reported:] {
+				log, _ := item.(map[string]interface{})
+				fmt.Printf(" * %v (%s)\n", log["action"], backoff.elapsed())
+			}
+			reported = len(logs)
+			if message := jobError(job); message != "" {
+				return fmt.Errorf("%s (after %s)", message, backoff.elapsed())
+			}
+			if _, finished := jobTime(job["finished_at"]); finished {
+				fmt.Printf(" * finished after %s\n", backoff.elapsed())
+				return nil
+			}
+		}
+		if err := backoff.sleep(); err != nil {
+			return fmt.Errorf("%w waiting for job %s", err, jobID)
+		}
+	}
+}
+
+// replaceJobFinishedWaiter makes all the generated commands that wait for a
+// job to finish use jobFinishedWaiter, which can be configured with
+// --timeout and --interval, instead of MistApiV2JobFinishedWaiter.
+func replaceJobFinishedWaiter() {
+	if cmd, _, err := cli.Root.Find([]string{"wait", "job-finished"}); err == nil && cmd.Name() == "job-finished" {
+		addWaiterFlags(cmd)
+		cmd.Example = `  mist wait job-finished 2c7c1f4b6a8d4e0b9f3a5d6e7f8a9b0c --timeout 2h`
+		cmd.Run = func(cmd *cobra.Command, args []string) {
+			params := viper.New()
+			params.BindPFlags(cmd.Flags())
+			if err := jobFinishedWaiter(args[0], params); err != nil {
+				exitWaiter(err)
+			}
+		}
+	}
+	if cmd, _, err := cli.Root.Find([]string{"create", "machine"}); err == nil && cmd.Name() == "machine" {
+		replaceCreateMachineWaiter(cmd)
+	}
+	if cmd, _, err := cli.Root.Find([]string{"create-machine"}); err == nil && cmd.Name() == "create-machine" {
+		replaceCreateMachineWaiter(cmd)
+	}
+}
+
+// replaceCreateMachineWaiter makes a generated create machine command wait
+// for the job that creates the machines with jobFinishedWaiter when --wait
+// is given.
+func replaceCreateMachineWaiter(cmd *cobra.Command) {
+	addWaiterFlags(cmd)
+	run := cmd.Run
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if wait, _ := cmd.Flags().GetBool("wait"); !wait {
+			run(cmd, args)
+			return
+		}
+		params := viper.New()
+		params.BindPFlags(cmd.Flags())
+		body, err := cli.GetBody("application/json", args[0:], params.GetString("filename"))
+		if err != nil {
+			logger.Fatalf("Unable to get body: %s", err.Error())
+		}
+
+		_, decoded, outputOptions, err := MistApiV2CreateMachine(params, body)
+		if err != nil {
+			logger.Fatalf("Error calling operation: %s", err.Error())
+		}
+
+		if err := cli.Formatter.Format(decoded, params, outputOptions); err != nil {
+			logger.Fatalf("Formatting failed: %s", err.Error())
+		}
+
+		jobID, err := jmespath.Search("jobId", decoded)
+		if err != nil || jobID == nil {
+			logger.Fatal("Could not get matcher value: jobId not found in response")
+		}
+		if err := jobFinishedWaiter(fmt.Sprintf("%v", jobID), params); err != nil {
+			logger.Fatalf("Create machine failed: %s", err.Error())
+		}
+
+		fmt.Println("Create machine completed successfully")
+	}
+}
+
+// waitCondition is the condition of the --for flag of a resource waiter.
+type waitCondition struct {
+	// JMESPath expression evaluated on the API response of the resource.
+	expression string
+	// If set, the expression must evaluate to this value instead of being
+	// truthy.
+	value    *string
+	deletion bool
+}
+
+// waitShorthand matches conditions in the form KEY=VALUE.
+var waitShorthand = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_.]*)=([^=].*)?$`)
+
+// jsonLiteral matches the JSON literals of a JMESPath expression.
+var jsonLiteral = regexp.MustCompile("`[^`]*`")
+
+// quoteJSONLiterals quotes the literals of a JMESPath expression that are
+// not valid JSON, such as `running`, which older JMESPath versions accept
+// as strings.
+func quoteJSONLiterals(expression string) string {
+	return jsonLiteral.ReplaceAllStringFunc(expression, func(literal string) string {
+		value := literal[1 : len(literal)-1]
+		if json.Valid([]byte(value)) {
+			return literal
+		}
+		quoted, _ := json.Marshal(strings.TrimSpace(value))
+		return "`" + string(quoted) + "`"
+	})
+}
+
+// parseWaitCondition parses the value of --for: delete, KEY=VALUE to wait
+// for a field of the resource to have a value, or a JMESPath expression
+// that must become truthy.
+func parseWaitCondition(s string) (waitCondition, error) {
+	if s == "delete" {
+		return waitCondition{deletion: true}, nil
+	}
+	expression := s
+	var value *string
+	if m := waitShorthand.FindStringSubmatch(s); m != nil {
+		expression = m[1]
+		if !strings.HasPrefix(expression, "data.") {
+			expression = "data." + expression
+		}
+		value = &m[2]
+	} else {
+		expression = quoteJSONLiterals(expression)
+	}
+	if _, err := jmespath.Compile(expression); err != nil {
+		return waitCondition{}, fmt.Errorf("Invalid condition %q: %s", s, err)
+	}
+	return waitCondition{expression: expression, value: value}, nil
+}
+
+// isTruthy returns whether a JMESPath result is true, according to the
+// JMESPath rules.
+func isTruthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+// check returns whether the condition holds for the API response of a
+// resource, and the current value of its expression.
+func (c waitCondition) check(decoded interface{}) (bool, string, error) {
+	result, err := jmespath.Search(c.expression, decoded)
+	if err != nil {
+		return false, "", err
+	}
+	current := fmt.Sprintf("%v", result)
+	if result == nil {
+		current = "null"
+	}
+	if c.value != nil {
+		return current == *c.value, current, nil
+	}
+	return isTruthy(result), current, nil
+}
+
+// resourceWaiter waits until a condition holds for a resource, printing
+// the value of the condition whenever it changes.
+func resourceWaiter(resourceType, name string, condition waitCondition, params *viper.Viper) error {
+	backoff := newWaiterBackoff(params)
+	last := ""
+	report := func(current string) {
+		if current != last {
+			fmt.Printf(" * %s: %s (%s)\n", condition.expression, current, backoff.elapsed())
+			last = current
+		}
+	}
+	for {
+		resp, decoded, _, err := resourceGetControllersMap[resourceType](name, viper.New())
+		switch {
+		case err != nil && resp != nil && resp.StatusCode == 404:
+			if condition.deletion {
+				fmt.Printf("%s %s deleted after %s\n", resourceType, name, backoff.elapsed())
+				return nil
+			}
+			report("not found")
+		case err != nil && !isRetryable(resp, err):
+			return fmt.Errorf("Could not get %s %s: %s", resourceType, name, err)
+		case err == nil && !condition.deletion:
+			met, current, err := condition.check(decoded)
+			if err != nil {
+				return err
+			}
+			report(current)
+			if met {
+				fmt.Printf("%s %s met the condition after %s\n", resourceType, name, backoff.elapsed())
+				return nil
+			}
+		}
+		if err := backoff.sleep(); err != nil {
+			return fmt.Errorf("%w waiting for %s %s", err, resourceType, name)
+		}
+	}
+}
+
+func resourceWaitCmd(resource string, aliases []string) *cobra.Command {
+	params := viper.New()
+	cmd := &cobra.Command{
+		Use:     resource + " NAME --for CONDITION",
+		Short:   "Wait until a condition holds for a " + resource,
+		Aliases: aliases,
+		Long: `Wait until a condition holds for a ` + resource + `, polling it with exponential
+  backoff. CONDITION is one of:
+
+    KEY=VALUE    a field of the ` + resource + ` has the given value
+    EXPRESSION   a JMESPath expression on the API response is true
+    delete       the ` + resource + ` no longer exists
+
+  The CLI exits with status 0 when the condition holds, 1 on errors and 2
+  if --timeout expires first.`,
+		Example: `  mist wait ` + resource + ` NAME --for delete --timeout 10m`,
+		Args:    cobra.ExactArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return tagValidArgsFunction(cmd, args, toComplete)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if params.GetString("for") == "" {
+				logger.Print("The --for flag is required")
+				os.Exit(waitExitError)
+			}
+			condition, err := parseWaitCondition(params.GetString("for"))
+			if err != nil {
+				logger.Print(err)
+				os.Exit(waitExitError)
+			}
+			if err := resourceWaiter(resource, args[0], condition, params); err != nil {
+				exitWaiter(err)
+			}
+		},
+	}
+	if resource == "machine" {
+		cmd.Example = "  mist wait machine NAME --for state=running --timeout 10m\n  mist wait machine NAME --for 'data.state==`running`'\n" + cmd.Example
+	}
+	cmd.Flags().String("for", "", "Condition to wait for: KEY=VALUE, a JMESPath expression or delete")
+	addWaiterFlags(cmd)
+
+	cli.SetCustomFlags(cmd)
+
+	if cmd.Flags().HasFlags() {
+		params.BindPFlags(cmd.Flags())
+	}
+	cmd.SetErr(os.Stderr)
+	return cmd
+}
+
+// addResourceWaiters adds a waiter for each resource to the generated wait
+// command.
+func addResourceWaiters() {
+	wait, _, err := cli.Root.Find([]string{"wait"})
+	if err != nil || wait.Name() != "wait" {
+		return
+	}
+	aliasesMap := calculateAliasesMap(taggableResources)
+	for _, resource := range taggableResources {
+		if _, ok := resourceGetControllersMap[resource]; ok {
+			wait.AddCommand(resourceWaitCmd(resource, aliasesMap[resource]))
+		}
+	}
+}
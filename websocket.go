@@ -1,68 +1,311 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-func readFromRemoteStdout(c *websocket.Conn, done *chan bool, pongWait time.Duration) {
-	defer func() { *done <- true }()
+// Exit codes of mist ssh when the session did not end normally. Sessions
+// that end normally exit with 0, or the exit status of the remote command.
+const (
+	// The connection was lost or could not be established. As in ssh(1),
+	// this is also the exit status of a remote command that exits with 255.
+	exitConnectionLost = 255
+	// The API key was rejected or lacks permission to ssh into the machine.
+	exitAuthRejected = 77
+	// The machine does not exist.
+	exitMachineNotFound = 68
+	// The session was interrupted by SIGINT or SIGTERM, as shells report
+	// commands killed by SIGINT.
+	exitInterrupted = 130
+	// The session timed out, as timeout(1) does.
+	exitTimedOut = 124
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	sessionWriteWait = 2 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	sessionPongWait = 10 * time.Second
+
+	// Send pings to peer with this period. Must be less than
+	// sessionPongWait.
+	sessionPingPeriod = (sessionPongWait * 9) / 10
+)
+
+var (
+	errConnectionLost  = errors.New("Connection lost")
+	errAuthRejected    = errors.New("Authentication rejected")
+	errMachineNotFound = errors.New("Machine not found")
+)
+
+// sessionExitCode returns the exit code of mist ssh for the error that
+// ended a session.
+func sessionExitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errAuthRejected):
+		return exitAuthRejected
+	case errors.Is(err, errMachineNotFound):
+		return exitMachineNotFound
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, context.DeadlineExceeded):
+		return exitTimedOut
+	default:
+		return exitConnectionLost
+	}
+}
+
+// exitSession prints the error that ended a session to stderr and exits
+// with the matching exit code.
+func exitSession(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(sessionExitCode(err))
+}
+
+// dialMachineShell requests the ssh action of a machine and opens the
+// websocket that proxies its shell.
+func dialMachineShell(machine string) (*websocket.Conn, error) {
+	err := setContext()
+	if err != nil {
+		return nil, fmt.Errorf("Could not set context %s", err)
+	}
+	server, err := getServer()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(server, "/") {
+		server = server + "/"
+	}
+	if !strings.HasPrefix(server, "http") {
+		server = "http://" + server
+	}
+	path := server + "api/v2/machines/" + machine + "/actions/ssh"
+	client := &http.Client{
+		Transport: newAPITransport(http.DefaultTransport),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+	req, err := http.NewRequest("POST", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := getToken()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not SSH into machine: %s", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("%w: could not SSH into machine %s: %s", errAuthRejected, machine, resp.Status)
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", errMachineNotFound, machine)
+	case resp.StatusCode/100 != 3:
+		return nil, fmt.Errorf("Could not SSH into machine: %s", resp.Status)
+	}
+	_, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	location := resp.Header.Get("location")
+	c, resp, err := dialWebsocket(location, http.Header{"Authorization": []string{token}})
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return nil, fmt.Errorf("%w: could not open shell of machine %s: %s", errAuthRejected, machine, resp.Status)
+		}
+		return nil, fmt.Errorf("Could not open shell of machine %s: %s", machine, err)
+	}
+	// Handle the case of redirections
+	if resp != nil && resp.StatusCode == 302 {
+		u, _ := resp.Location()
+		c, resp, err = dialWebsocket(u.String(), http.Header{"Authorization": []string{token}})
+		if err != nil {
+			return nil, fmt.Errorf("Could not open shell of machine %s: %s", machine, err)
+		}
+	}
+	return c, nil
+}
+
+// The goroutines relaying a session send their result on errc once: nil
+// when the session ended normally and an error wrapping errConnectionLost
+// when the connection was lost. They return early when ctx is done.
+
+func readFromRemoteStdout(c *websocket.Conn, out io.Writer, errc chan<- error, pongWait time.Duration) {
 	c.SetReadDeadline(time.Now().Add(pongWait))
-	c.SetPongHandler(func(string) error { c.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.SetPongHandler(func(appData string) error {
+		c.SetReadDeadline(time.Now().Add(pongWait))
+		sessionConnection.pong(appData)
+		return nil
+	})
 	for {
 		mt, r, err := c.NextReader()
 		if websocket.IsCloseError(err,
 			websocket.CloseNormalClosure, // Normal.
 		) {
+			errc <- nil
 			return
 		}
 		if err != nil {
-			fmt.Printf("nextreader: %v\n", err)
+			errc <- fmt.Errorf("%w: %s", errConnectionLost, err)
 			return
 		}
 		if mt != websocket.BinaryMessage {
-			fmt.Println("binary message")
+			errc <- fmt.Errorf("%w: unexpected message from the remote end", errConnectionLost)
+			return
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			errc <- fmt.Errorf("%w: %s", errConnectionLost, err)
 			return
 		}
-		if _, err := io.Copy(os.Stdout, r); err != nil {
-			fmt.Printf("Reading from websocket: %v\n", err)
+	}
+}
+
+// readLocalStdin reads the local stdin and sends it to input, so that it
+// can be forwarded to more than one connection in turn. Each read returns
+// whatever is available, up to remoteInputChunkSize bytes, so that pasted
+// text is not split into single bytes. input is closed when stdin is
+// closed.
+func readLocalStdin(input chan<- []byte) {
+	defer close(input)
+	buf := make([]byte, remoteInputChunkSize)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			input <- append([]byte{}, buf[:n]...)
+		}
+		if err != nil {
 			return
 		}
 	}
 }
 
-func writeToRemoteStdin(c *websocket.Conn, done *chan bool, writeMutex *sync.Mutex, writeWait time.Duration) {
-	defer func() { *done <- true }()
+// writeToRemoteStdin forwards input to the remote shell. Input that is
+// already queued when a message is sent is coalesced into that message, up
+// to remoteInputChunkSize bytes. The input is copied into a buffer of its
+// own, so the slices received from input are never written to.
+func writeToRemoteStdin(ctx context.Context, c *websocket.Conn, errc chan<- error, writeMutex *sync.Mutex, writeWait time.Duration, input <-chan []byte) {
+	// The message, starting with the byte that marks it as input.
+	message := make([]byte, 1, 1+remoteInputChunkSize)
+	// Input that did not fit in the previous message.
+	var next []byte
+	closed := false
 	for {
-		var input []byte = make([]byte, 1)
-		os.Stdin.Read(input)
+		data := next
+		next = nil
+		if data == nil {
+			if closed {
+				errc <- nil
+				return
+			}
+			var ok bool
+			select {
+			case data, ok = <-input:
+				if !ok {
+					errc <- nil
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(data) > remoteInputChunkSize {
+			data, next = data[:remoteInputChunkSize], data[remoteInputChunkSize:]
+		}
+		message = append(message[:1], data...)
+	coalesce:
+		for next == nil && !closed && len(message)-1 < remoteInputChunkSize {
+			select {
+			case more, ok := <-input:
+				if !ok {
+					closed = true
+					break coalesce
+				}
+				if room := remoteInputChunkSize - (len(message) - 1); len(more) > room {
+					more, next = more[:room], more[room:]
+				}
+				message = append(message, more...)
+			default:
+				break coalesce
+			}
+		}
 		writeMutex.Lock()
 		c.SetWriteDeadline(time.Now().Add(writeWait))
-		err := c.WriteMessage(websocket.BinaryMessage, append([]byte{0}, input...))
+		err := c.WriteMessage(websocket.BinaryMessage, message)
 		writeMutex.Unlock()
 		if err != nil {
-			fmt.Println("write:", err)
+			errc <- fmt.Errorf("%w: %s", errConnectionLost, err)
 			return
 		}
+		sessionRecorder.input(message[1:])
 	}
 }
 
-func sendPingMessages(c *websocket.Conn, done *chan bool, writeWait time.Duration, pingPeriod time.Duration) {
-	defer func() { *done <- true }()
+func sendPingMessages(ctx context.Context, c *websocket.Conn, errc chan<- error, writeWait time.Duration, pingPeriod time.Duration) {
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			if err := c.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
-				fmt.Println("ping:", err)
+			// The pong carries the time the ping was sent, to measure
+			// the latency of the connection.
+			sent := strconv.FormatInt(time.Now().UnixNano(), 10)
+			if err := c.WriteControl(websocket.PingMessage, []byte(sent), time.Now().Add(writeWait)); err != nil {
+				errc <- fmt.Errorf("%w: %s", errConnectionLost, err)
 				return
 			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
+
+// runShellSession relays the local terminal to the shell proxied by c
+// until either side closes it or ctx is done. It returns nil if the
+// session ended normally.
+func runShellSession(ctx context.Context, c *websocket.Conn, input <-chan []byte, writeWait, pongWait, pingPeriod time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Buffered, so that the goroutines still running after the session
+	// ended do not block.
+	errc := make(chan error, 4)
+
+	var writeMutex sync.Mutex
+
+	err := updateTerminalSize(c, &writeMutex, writeWait)
+	if err != nil {
+		return err
+	}
+
+	sessionConnection.connected(c)
+
+	go handleTerminalResize(ctx, c, errc, &writeMutex, writeWait)
+	go readFromRemoteStdout(c, sessionStdout(), errc, pongWait)
+	go writeToRemoteStdin(ctx, c, errc, &writeMutex, writeWait, input)
+	go sendPingMessages(ctx, c, errc, writeWait, pingPeriod)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("Session ended: %w", ctx.Err())
+	}
+}
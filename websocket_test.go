@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Size of the paste sent by the benchmarks.
+const benchmarkPasteSize = 64 * 1024
+
+// echoServer is a websocket server that echoes the messages it receives
+// and counts them.
+type echoServer struct {
+	*httptest.Server
+	frames int64
+}
+
+func newEchoServer(tb testing.TB) *echoServer {
+	s := &echoServer{}
+	upgrader := websocket.Upgrader{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&s.frames, 1)
+			if err := c.WriteMessage(mt, data); err != nil {
+				return
+			}
+		}
+	}))
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// dial opens a websocket to the server and returns it with a channel that
+// receives the input echoed back by each message.
+func (s *echoServer) dial(tb testing.TB) (*websocket.Conn, <-chan []byte) {
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Close() })
+	echoed := make(chan []byte, 1024)
+	go func() {
+		defer close(echoed)
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			// The first byte marks the message as input.
+			echoed <- data[1:]
+		}
+	}()
+	return c, echoed
+}
+
+// waitEchoed waits until total bytes of input were echoed back.
+func waitEchoed(tb testing.TB, echoed <-chan []byte, total int) {
+	for received := 0; received < total; {
+		data, ok := <-echoed
+		if !ok {
+			tb.Fatal("connection closed")
+		}
+		received += len(data)
+	}
+}
+
+// BenchmarkWriteToRemoteStdin compares forwarding a paste, read one byte at
+// a time as a terminal may deliver it, with writeToRemoteStdin against
+// sending one frame per byte.
+func BenchmarkWriteToRemoteStdin(b *testing.B) {
+	paste := bytes.Repeat([]byte("0123456789abcdef"), benchmarkPasteSize/16)
+
+	b.Run("coalesced", func(b *testing.B) {
+		s := newEchoServer(b)
+		c, echoed := s.dial(b)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		input := make(chan []byte, 64)
+		errc := make(chan error, 1)
+		var writeMutex sync.Mutex
+		go writeToRemoteStdin(ctx, c, errc, &writeMutex, sessionWriteWait, input)
+		b.SetBytes(int64(len(paste)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := range paste {
+				input <- paste[j : j+1]
+			}
+			waitEchoed(b, echoed, len(paste))
+		}
+		b.StopTimer()
+		b.ReportMetric(float64(atomic.LoadInt64(&s.frames))/float64(b.N), "frames/op")
+	})
+
+	b.Run("frame-per-byte", func(b *testing.B) {
+		s := newEchoServer(b)
+		c, echoed := s.dial(b)
+		b.SetBytes(int64(len(paste)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := range paste {
+				if err := c.WriteMessage(websocket.BinaryMessage, []byte{0, paste[j]}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			waitEchoed(b, echoed, len(paste))
+		}
+		b.StopTimer()
+		b.ReportMetric(float64(atomic.LoadInt64(&s.frames))/float64(b.N), "frames/op")
+	})
+}
+
+// TestWriteToRemoteStdinChunkSize checks that coalesced messages are never
+// larger than remoteInputChunkSize and that no input is lost.
+func TestWriteToRemoteStdinChunkSize(t *testing.T) {
+	s := newEchoServer(t)
+	c, echoed := s.dial(t)
+	input := make(chan []byte, 64)
+	errc := make(chan error, 1)
+	var writeMutex sync.Mutex
+	go writeToRemoteStdin(context.Background(), c, errc, &writeMutex, sessionWriteWait, input)
+	total := 0
+	for _, size := range []int{remoteInputChunkSize - 1, remoteInputChunkSize, 3 * remoteInputChunkSize / 2, 1, remoteInputChunkSize + 1} {
+		input <- make([]byte, size)
+		total += size
+	}
+	close(input)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	for received := 0; received < total; {
+		data, ok := <-echoed
+		if !ok {
+			t.Fatalf("connection closed after %d of %d bytes", received, total)
+		}
+		if len(data) > remoteInputChunkSize {
+			t.Fatalf("message of %d bytes is larger than %d", len(data), remoteInputChunkSize)
+		}
+		received += len(data)
+	}
+}
+
+// TestWriteToRemoteStdinOrder checks that coalesced messages keep the order
+// of the input and that the slices received are not written to.
+func TestWriteToRemoteStdinOrder(t *testing.T) {
+	s := newEchoServer(t)
+	c, echoed := s.dial(t)
+	input := make(chan []byte, 256)
+	var want []byte
+	var sent [][]byte
+	for i := 0; i < 256; i++ {
+		// Spare capacity, where appending to the slice would write.
+		data := bytes.Repeat([]byte{'-'}, 1+i%7+remoteInputChunkSize/64)
+		data = data[:1+i%7]
+		for j := range data {
+			data[j] = byte('a' + (i+j)%26)
+		}
+		want = append(want, data...)
+		sent = append(sent, data)
+		input <- data
+	}
+	close(input)
+	errc := make(chan error, 1)
+	var writeMutex sync.Mutex
+	go writeToRemoteStdin(context.Background(), c, errc, &writeMutex, sessionWriteWait, input)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	messages := 0
+	for len(got) < len(want) {
+		data, ok := <-echoed
+		if !ok {
+			t.Fatalf("connection closed after %d of %d bytes", len(got), len(want))
+		}
+		got = append(got, data...)
+		messages++
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if messages == len(sent) {
+		t.Fatal("input was not coalesced")
+	}
+	for i, data := range sent {
+		if spare := data[len(data):cap(data)]; !bytes.Equal(spare, bytes.Repeat([]byte{'-'}, len(spare))) {
+			t.Fatalf("input %d was written to", i)
+		}
+	}
+}
+
+func TestSessionExitCode(t *testing.T) {
+	timedOut, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-timedOut.Done()
+	for _, test := range []struct {
+		err  error
+		code int
+	}{
+		{nil, 0},
+		{fmt.Errorf("%w: EOF", errConnectionLost), exitConnectionLost},
+		{errAuthRejected, exitAuthRejected},
+		{errMachineNotFound, exitMachineNotFound},
+		{fmt.Errorf("Session ended: %w", context.Canceled), exitInterrupted},
+		{fmt.Errorf("Session ended: %w", timedOut.Err()), exitTimedOut},
+	} {
+		if code := sessionExitCode(test.err); code != test.code {
+			t.Errorf("%v: exit code %d, want %d", test.err, code, test.code)
+		}
+	}
+}